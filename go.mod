@@ -1,10 +1,10 @@
 module github.com/blackbass1988/s3uploader
 
-go 1.12
+go 1.18
 
 require (
 	github.com/gabriel-vasile/mimetype v1.1.1
 	github.com/mitchellh/goamz v0.0.0-20150317174335-caaaea8b30ee
 	github.com/motain/gocheck v0.0.0-20131023154940-9beb271d26e6 // indirect
-	github.com/vaughan0/go-ini v0.0.0-20130923145212-a98ad7ee00ec // indirect
+	github.com/vaughan0/go-ini v0.0.0-20130923145212-a98ad7ee00ec
 )
@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var UnmappedGranteeError = errors.New("grantee has no owner mapping")
+var InvalidOwnerMapError = errors.New("invalid owner mapping")
+
+var grantHeaders = map[string]string{
+	"READ":         "X-Amz-Grant-Read",
+	"WRITE":        "X-Amz-Grant-Write",
+	"READ_ACP":     "X-Amz-Grant-Read-Acp",
+	"WRITE_ACP":    "X-Amz-Grant-Write-Acp",
+	"FULL_CONTROL": "X-Amz-Grant-Full-Control",
+}
+
+// OwnerMap maps canonical user IDs of the source cluster to the IDs of the
+// destination cluster.
+type OwnerMap map[string]string
+
+// LoadOwnerMap reads "sourceID destinationID" lines from the file at name.
+// Empty lines and lines starting with # are skipped.
+func LoadOwnerMap(name string) (owners OwnerMap, err error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	owners = make(OwnerMap)
+
+	lineNumber := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			err = fmt.Errorf("%w: %s:%d: %q is not \"sourceID destinationID\"", InvalidOwnerMapError, name, lineNumber, line)
+			return
+		}
+		owners[fields[0]] = fields[1]
+	}
+
+	err = scanner.Err()
+
+	return
+}
+
+// GrantHeaders returns the x-amz-grant-* headers which reproduce the grants
+// of policy. User IDs are mapped by owners. Grants of the source owner
+// without a mapping are left out, as the uploader owns the copy and has
+// full control of it anyway.
+func GrantHeaders(policy AccessControlPolicy, owners OwnerMap) (headers http.Header, err error) {
+	headers = make(http.Header)
+
+	for _, g := range policy.AccessControlList.Grants {
+		name, ok := grantHeaders[g.Permission]
+		if !ok {
+			err = fmt.Errorf("%w: unknown permission %q", NotImplementedAclMappingError, g.Permission)
+			return
+		}
+
+		var grantee string
+
+		switch {
+		case g.Gruntee.URI != "":
+			grantee = fmt.Sprintf("uri=%q", g.Gruntee.URI)
+		case g.Gruntee.EmailAddress != "":
+			grantee = fmt.Sprintf("emailAddress=%q", g.Gruntee.EmailAddress)
+		case g.Gruntee.ID != "":
+			id, mapped := owners[g.Gruntee.ID]
+			if !mapped {
+				if g.Gruntee.ID == policy.Owner.ID {
+					continue
+				}
+				err = fmt.Errorf("%w: %s (%s)", UnmappedGranteeError, g.Gruntee.ID, g.Gruntee.DisplayName)
+				return
+			}
+			grantee = fmt.Sprintf("id=%q", id)
+		default:
+			err = fmt.Errorf("%w: grantee without uri, id or email", NotImplementedAclMappingError)
+			return
+		}
+
+		if v := headers.Get(name); v != "" {
+			grantee = v + ", " + grantee
+		}
+		headers.Set(name, grantee)
+	}
+
+	return
+}
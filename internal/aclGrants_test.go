@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestLoadOwnerMap(t *testing.T) {
+	tests := []struct {
+		content  string
+		expected OwnerMap
+		failed   bool
+	}{
+		{"# source destination\n\nold-a new-a\n  old-b\tnew-b  \n", OwnerMap{"old-a": "new-a", "old-b": "new-b"}, false},
+		{"", OwnerMap{}, false},
+		{"old-a\n", nil, true},
+		{"old-a new-a extra\n", nil, true},
+	}
+
+	for _, test := range tests {
+		file, err := ioutil.TempFile("", "owners")
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.WriteString(test.content)
+		file.Close()
+
+		owners, err := LoadOwnerMap(file.Name())
+		os.Remove(file.Name())
+
+		if test.failed {
+			if !errors.Is(err, InvalidOwnerMapError) {
+				t.Errorf("%q: error %v, expected InvalidOwnerMapError", test.content, err)
+			}
+			continue
+		}
+
+		if err != nil || !reflect.DeepEqual(owners, test.expected) {
+			t.Errorf("%q: owners %v, %v, expected %v", test.content, owners, err, test.expected)
+		}
+	}
+
+	if _, err := LoadOwnerMap("/nonexistent/owners"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing file: %v", err)
+	}
+}
+
+func TestGrantHeaders(t *testing.T) {
+	const allUsers = "http://acs.amazonaws.com/groups/global/AllUsers"
+
+	owners := OwnerMap{"old-owner": "new-owner", "old-user": "new-user"}
+
+	grant := func(permission string, grantee Grantee) Grant {
+		return Grant{Gruntee: grantee, Permission: permission}
+	}
+	policy := func(owner string, grants ...Grant) AccessControlPolicy {
+		return AccessControlPolicy{Owner: Owner{ID: owner}, AccessControlList: AccessControlList{Grants: grants}}
+	}
+
+	tests := []struct {
+		name     string
+		policy   AccessControlPolicy
+		expected http.Header
+		err      error
+	}{
+		{"uri", policy("owner", grant("READ", Grantee{URI: allUsers})), http.Header{
+			"X-Amz-Grant-Read": {`uri="` + allUsers + `"`},
+		}, nil},
+		{"email", policy("owner", grant("WRITE_ACP", Grantee{EmailAddress: "a@example.com"})), http.Header{
+			"X-Amz-Grant-Write-Acp": {`emailAddress="a@example.com"`},
+		}, nil},
+		{"mapped id", policy("owner", grant("FULL_CONTROL", Grantee{ID: "old-user"})), http.Header{
+			"X-Amz-Grant-Full-Control": {`id="new-user"`},
+		}, nil},
+		{"mapped owner", policy("old-owner", grant("FULL_CONTROL", Grantee{ID: "old-owner"})), http.Header{
+			"X-Amz-Grant-Full-Control": {`id="new-owner"`},
+		}, nil},
+		{"unmapped owner dropped", policy("owner",
+			grant("FULL_CONTROL", Grantee{ID: "owner"}),
+			grant("READ", Grantee{URI: allUsers}),
+		), http.Header{
+			"X-Amz-Grant-Read": {`uri="` + allUsers + `"`},
+		}, nil},
+		{"grantees joined", policy("owner",
+			grant("READ", Grantee{URI: allUsers}),
+			grant("READ", Grantee{ID: "old-user"}),
+			grant("READ", Grantee{EmailAddress: "a@example.com"}),
+			grant("READ_ACP", Grantee{ID: "old-user"}),
+		), http.Header{
+			"X-Amz-Grant-Read":     {`uri="` + allUsers + `", id="new-user", emailAddress="a@example.com"`},
+			"X-Amz-Grant-Read-Acp": {`id="new-user"`},
+		}, nil},
+		{"no grants", policy("owner"), http.Header{}, nil},
+		{"unmapped user", policy("owner", grant("READ", Grantee{ID: "stranger", DisplayName: "Stranger"})), nil, UnmappedGranteeError},
+		{"unknown permission", policy("owner", grant("LIST", Grantee{URI: allUsers})), nil, NotImplementedAclMappingError},
+		{"empty grantee", policy("owner", grant("READ", Grantee{DisplayName: "nobody"})), nil, NotImplementedAclMappingError},
+	}
+
+	for _, test := range tests {
+		headers, err := GrantHeaders(test.policy, owners)
+
+		if test.err != nil {
+			if !errors.Is(err, test.err) {
+				t.Errorf("%s: error %v, expected %v", test.name, err, test.err)
+			}
+			continue
+		}
+
+		if err != nil || !reflect.DeepEqual(headers, test.expected) {
+			t.Errorf("%s: headers %v, %v, expected %v", test.name, headers, err, test.expected)
+		}
+	}
+}
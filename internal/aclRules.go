@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mitchellh/goamz/s3"
+	"path"
+	"strings"
+)
+
+var InvalidAclError = errors.New("invalid acl")
+
+var cannedAcls = []s3.ACL{
+	s3.Private,
+	s3.PublicRead,
+	s3.PublicReadWrite,
+	s3.AuthenticatedRead,
+	s3.BucketOwnerRead,
+	s3.BucketOwnerFull,
+}
+
+// ParseAcl returns the canned ACL named name.
+func ParseAcl(name string) (acl s3.ACL, err error) {
+	for _, canned := range cannedAcls {
+		if string(canned) == name {
+			acl = canned
+			return
+		}
+	}
+
+	err = fmt.Errorf("%w: %q, use one of %v", InvalidAclError, name, cannedAcls)
+
+	return
+}
+
+type AclRule struct {
+	Pattern string
+	Acl     s3.ACL
+}
+
+// ParseAclRule parses "pattern=acl".
+func ParseAclRule(s string) (rule AclRule, err error) {
+	pattern, name, ok := strings.Cut(s, "=")
+	if !ok || pattern == "" {
+		err = fmt.Errorf("%w: %q is not pattern=acl", InvalidAclError, s)
+		return
+	}
+
+	if _, err = path.Match(pattern, ""); err != nil {
+		err = fmt.Errorf("%w: %q: %v", InvalidAclError, pattern, err)
+		return
+	}
+
+	rule.Pattern = pattern
+	rule.Acl, err = ParseAcl(name)
+
+	return
+}
+
+// AclRules choose the ACL of uploaded local files by their keys. The first
+// matching rule wins, keys matching none get Default.
+//
+// The last element of a pattern is matched against the base name of the key
+// and the elements before it against the directory of the key or any of its
+// parents, so "*.pdf" matches every pdf, "docs/private/*.pdf" the pdfs
+// anywhere under docs/private and "docs/private/" every key under it.
+type AclRules struct {
+	Default s3.ACL
+	Rules   []AclRule
+}
+
+func (r AclRules) Acl(key string) s3.ACL {
+	for _, rule := range r.Rules {
+		if matchKey(rule.Pattern, key) {
+			return rule.Acl
+		}
+	}
+	return r.Default
+}
+
+func matchKey(pattern string, key string) bool {
+	key = strings.TrimPrefix(key, "/")
+	dir, base := path.Split(strings.TrimPrefix(pattern, "/"))
+
+	if base != "" {
+		if ok, _ := path.Match(base, path.Base(key)); !ok {
+			return false
+		}
+	}
+
+	if dir == "" {
+		return true
+	}
+
+	dir = strings.TrimSuffix(dir, "/")
+	for i := 0; i < len(key); i++ {
+		if key[i] != '/' {
+			continue
+		}
+		if ok, _ := path.Match(dir, key[:i]); ok {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"errors"
+	"github.com/mitchellh/goamz/s3"
+	"testing"
+)
+
+func TestMatchKey(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		key      string
+		expected bool
+	}{
+		{"*.pdf", "a.pdf", true},
+		{"*.pdf", "docs/a.pdf", true},
+		{"*.pdf", "/docs/private/x/a.pdf", true},
+		{"*.pdf", "a.pdf.txt", false},
+		{"*.pdf", "pdf/a.txt", false},
+		{"docs/private/*.pdf", "docs/private/a.pdf", true},
+		{"docs/private/*.pdf", "docs/private/x/a.pdf", true},
+		{"docs/private/*.pdf", "docs/private/x/y/a.pdf", true},
+		{"docs/private/*.pdf", "/docs/private/a.pdf", true},
+		{"docs/private/*.pdf", "docs/a.pdf", false},
+		{"docs/private/*.pdf", "docs/public/a.pdf", false},
+		{"docs/private/*.pdf", "docs/private/a.txt", false},
+		{"docs/private/*.pdf", "other/docs/private/a.pdf", false},
+		{"docs/private/*.pdf", "docs/private.pdf", false},
+		{"docs/private/", "docs/private/a.txt", true},
+		{"docs/private/", "docs/private/x/a.pdf", true},
+		{"docs/private/", "docs/privateer/a.txt", false},
+		{"docs/private/", "docs/private", false},
+		{"/docs/private/", "docs/private/a.txt", true},
+		{"/docs/private/", "/docs/private/a.txt", true},
+		{"/*.pdf", "docs/a.pdf", true},
+		{"docs/*/", "docs/a/b.txt", true},
+		{"docs/*/", "docs/b.txt", false},
+	}
+
+	for _, test := range tests {
+		if actual := matchKey(test.pattern, test.key); actual != test.expected {
+			t.Errorf("matchKey(%q, %q) = %v, expected %v", test.pattern, test.key, actual, test.expected)
+		}
+	}
+}
+
+func TestAclRulesAcl(t *testing.T) {
+	rules := AclRules{
+		Default: s3.Private,
+		Rules: []AclRule{
+			{"docs/private/", s3.Private},
+			{"*.pdf", s3.PublicRead},
+			{"docs/", s3.AuthenticatedRead},
+		},
+	}
+
+	tests := []struct {
+		key      string
+		expected s3.ACL
+	}{
+		{"docs/private/a.pdf", s3.Private}, //first match wins
+		{"docs/a.pdf", s3.PublicRead},
+		{"docs/a.txt", s3.AuthenticatedRead},
+		{"a.txt", s3.Private},
+		{"/a.pdf", s3.PublicRead},
+	}
+
+	for _, test := range tests {
+		if actual := rules.Acl(test.key); actual != test.expected {
+			t.Errorf("Acl(%q) = %s, expected %s", test.key, actual, test.expected)
+		}
+	}
+}
+
+func TestParseAclRule(t *testing.T) {
+	rule, err := ParseAclRule("docs/*.pdf=public-read")
+	if err != nil || rule.Pattern != "docs/*.pdf" || rule.Acl != s3.PublicRead {
+		t.Errorf("rule %+v, %v", rule, err)
+	}
+
+	for _, s := range []string{"*.pdf", "=private", "*.pdf=public", "[.pdf=private"} {
+		if _, err = ParseAclRule(s); !errors.Is(err, InvalidAclError) {
+			t.Errorf("%q: error %v, expected InvalidAclError", s, err)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const limitedReadChunk = 32 * 1024 //max bytes read at once through a limit
+
+// TokenBucket limits the rate of bytes passed through it. Up to a second
+// of unused rate is saved up for bursts. A rate of 0 is unlimited.
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 //bytes per second
+	tokens float64
+	last   time.Time
+}
+
+func NewTokenBucket(rate int64) *TokenBucket {
+	b := &TokenBucket{}
+	b.SetRate(rate)
+	return b
+}
+
+// SetRate changes the rate, waiting readers keep their computed delay.
+func (b *TokenBucket) SetRate(rate int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.rate = float64(rate)
+	b.tokens = 0
+	b.last = time.Now()
+}
+
+func (b *TokenBucket) Rate() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return int64(b.rate)
+}
+
+// Wait blocks until n bytes may pass.
+func (b *TokenBucket) Wait(n int) {
+	b.mu.Lock()
+
+	if b.rate <= 0 {
+		b.mu.Unlock()
+		return
+	}
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+
+	//tokens may go below zero, the debt is paid by sleeping
+	b.tokens -= float64(n)
+	delay := time.Duration(-b.tokens / b.rate * float64(time.Second))
+
+	b.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+type limitedReader struct {
+	reader  io.Reader
+	buckets []*TokenBucket
+}
+
+// NewLimitedReader returns a reader of r passing every bucket. Nil buckets
+// are ignored.
+func NewLimitedReader(r io.Reader, buckets ...*TokenBucket) io.Reader {
+	var active []*TokenBucket
+	for _, b := range buckets {
+		if b != nil {
+			active = append(active, b)
+		}
+	}
+
+	if len(active) == 0 {
+		return r
+	}
+
+	return &limitedReader{reader: r, buckets: active}
+}
+
+func (r *limitedReader) Read(p []byte) (n int, err error) {
+	if len(p) > limitedReadChunk {
+		p = p[:limitedReadChunk]
+	}
+
+	n, err = r.reader.Read(p)
+
+	for _, b := range r.buckets {
+		b.Wait(n)
+	}
+
+	return
+}
+
+// Limits keeps the global limit and the limits of endpoints. The zero
+// value is unlimited.
+type Limits struct {
+	mu        sync.Mutex
+	global    *TokenBucket
+	endpoints map[string]*TokenBucket
+}
+
+func NewLimits(global int64, endpoints map[string]int64) *Limits {
+	l := &Limits{}
+	l.Set(global, endpoints)
+	return l
+}
+
+// Global returns the bucket shared by all transfers.
+func (l *Limits) Global() *TokenBucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.global == nil {
+		l.global = NewTokenBucket(0)
+	}
+
+	return l.global
+}
+
+// Endpoint returns the bucket of endpoint. Endpoints without a limit get
+// an unlimited bucket, so a limit can be set for them later.
+func (l *Limits) Endpoint(endpoint string) *TokenBucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.endpoints == nil {
+		l.endpoints = make(map[string]*TokenBucket)
+	}
+
+	b := l.endpoints[endpoint]
+	if b == nil {
+		b = NewTokenBucket(0)
+		l.endpoints[endpoint] = b
+	}
+
+	return b
+}
+
+// Set replaces the global limit and the limits of endpoints. Endpoints
+// missing from endpoints become unlimited.
+func (l *Limits) Set(global int64, endpoints map[string]int64) {
+	if b := l.Global(); b.Rate() != global {
+		b.SetRate(global)
+	}
+
+	for endpoint, rate := range endpoints {
+		if b := l.Endpoint(endpoint); b.Rate() != rate {
+			b.SetRate(rate)
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for endpoint, b := range l.endpoints {
+		if _, ok := endpoints[endpoint]; !ok && b.Rate() != 0 {
+			b.SetRate(0)
+		}
+	}
+}
+
+// ParseRate parses bytes per second with an optional K, M or G suffix
+// (powers of 1024), like "512K" or "10M".
+func ParseRate(s string) (rate int64, err error) {
+	s = strings.TrimSpace(s)
+	multiplier := int64(1)
+
+	if len(s) > 0 {
+		switch strings.ToUpper(s[len(s)-1:]) {
+		case "K":
+			multiplier = 1024
+		case "M":
+			multiplier = 1024 * 1024
+		case "G":
+			multiplier = 1024 * 1024 * 1024
+		}
+		if multiplier > 1 {
+			s = s[:len(s)-1]
+		}
+	}
+
+	rate, err = strconv.ParseInt(s, 10, 64)
+	if err == nil && rate < 0 {
+		err = fmt.Errorf("negative rate %d", rate)
+	}
+
+	rate *= multiplier
+
+	return
+}
+
+// ParseEndpointRate parses "endpoint=rate". The endpoint is the host
+// Limits.Endpoint is called with, without a http:// or https:// prefix.
+func ParseEndpointRate(s string) (endpoint string, rate int64, err error) {
+	i := strings.LastIndex(s, "=")
+	if i <= 0 {
+		err = fmt.Errorf("%q is not endpoint=rate", s)
+		return
+	}
+
+	endpoint, _ = SplitEndpoint(s[:i], "", false)
+	rate, err = ParseRate(s[i+1:])
+
+	return
+}
+
+// LoadLimits reads the limits file at name. Every line is a rate: the
+// global one, or of an endpoint as "endpoint=rate". Lines starting with #
+// are comments. ok is false if the file has no global rate.
+func LoadLimits(name string) (global int64, ok bool, endpoints map[string]int64, err error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	endpoints = make(map[string]int64)
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if !strings.Contains(line, "=") {
+			if global, err = ParseRate(line); err != nil {
+				return
+			}
+			ok = true
+			continue
+		}
+
+		endpoint, rate, parseErr := ParseEndpointRate(line)
+		if parseErr != nil {
+			err = parseErr
+			return
+		}
+		endpoints[endpoint] = rate
+	}
+
+	err = scanner.Err()
+
+	return
+}
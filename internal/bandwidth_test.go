@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		s        string
+		expected int64
+		failed   bool
+	}{
+		{"0", 0, false},
+		{"512", 512, false},
+		{" 512K ", 512 * 1024, false},
+		{"10m", 10 * 1024 * 1024, false},
+		{"2G", 2 * 1024 * 1024 * 1024, false},
+		{"", 0, true},
+		{"M", 0, true},
+		{"1.5M", 0, true},
+		{"-1K", 0, true},
+	}
+
+	for _, test := range tests {
+		rate, err := ParseRate(test.s)
+		if (err != nil) != test.failed || !test.failed && rate != test.expected {
+			t.Errorf("ParseRate(%q) = %d, %v", test.s, rate, err)
+		}
+	}
+}
+
+func TestParseEndpointRate(t *testing.T) {
+	for _, s := range []string{"host:9000=5M", "http://host:9000=5M", "https://host:9000/=5M"} {
+		endpoint, rate, err := ParseEndpointRate(s)
+		if err != nil || endpoint != "host:9000" || rate != 5*1024*1024 {
+			t.Errorf("%q parsed to %q, %d, %v", s, endpoint, rate, err)
+		}
+	}
+
+	for _, s := range []string{"5M", "=5M", "host=fast"} {
+		if _, _, err := ParseEndpointRate(s); err == nil {
+			t.Errorf("%q accepted", s)
+		}
+	}
+}
+
+func TestTokenBucketWait(t *testing.T) {
+	b := NewTokenBucket(10000)
+
+	start := time.Now()
+	b.Wait(1000)
+	b.Wait(1000)
+	elapsed := time.Since(start)
+
+	if elapsed < 150*time.Millisecond || elapsed > time.Second {
+		t.Errorf("2000 bytes at 10000 B/s passed in %s", elapsed)
+	}
+
+	start = time.Now()
+	NewTokenBucket(0).Wait(1 << 30)
+	if elapsed = time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("unlimited bucket waited %s", elapsed)
+	}
+}
+
+func TestLimitsSet(t *testing.T) {
+	l := NewLimits(100, map[string]int64{"a": 10, "b": 20})
+
+	l.Set(200, map[string]int64{"b": 30, "c": 40})
+
+	if rate := l.Global().Rate(); rate != 200 {
+		t.Errorf("global %d", rate)
+	}
+
+	expected := map[string]int64{"a": 0, "b": 30, "c": 40, "d": 0}
+	for endpoint, rate := range expected {
+		if actual := l.Endpoint(endpoint).Rate(); actual != rate {
+			t.Errorf("endpoint %s: %d, expected %d", endpoint, actual, rate)
+		}
+	}
+}
+
+func TestLoadLimits(t *testing.T) {
+	file, err := ioutil.TempFile("", "limits")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	file.WriteString("# limits\n20M\n\nold.example.com=5M\n")
+	file.Close()
+
+	global, ok, endpoints, err := LoadLimits(file.Name())
+	if err != nil || !ok || global != 20*1024*1024 || len(endpoints) != 1 || endpoints["old.example.com"] != 5*1024*1024 {
+		t.Errorf("global %d, %v, endpoints %v, error %v", global, ok, endpoints, err)
+	}
+}
@@ -20,7 +20,8 @@ type Grant struct {
 }
 
 type Grantee struct {
-	URI         string `xml:"URI"`
-	ID          string `xml:"ID"`
-	DisplayName string `xml:"DisplayName"`
+	URI          string `xml:"URI"`
+	ID           string `xml:"ID"`
+	DisplayName  string `xml:"DisplayName"`
+	EmailAddress string `xml:"EmailAddress"`
 }
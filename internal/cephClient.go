@@ -1,55 +1,122 @@
 package internal
 
 import (
+	"context"
 	"github.com/mitchellh/goamz/aws"
 	"github.com/mitchellh/goamz/s3"
 	"log"
 	"net"
 	"net/http"
+	"strings"
 	"time"
 )
 
-func GetS3Client(useHttp bool, accessKey string, secretKey string, endpoint string, maxRoutineSize int) (client *s3.S3) {
+// idleTimeoutConn extends the connection deadline on every read and write,
+// so long transfers are not cut off while stalled ones still fail.
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleTimeoutConn) Read(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
+
+func (c *idleTimeoutConn) Write(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(b)
+}
+
+// S3ClientConfig describes how to connect to a single s3 endpoint.
+type S3ClientConfig struct {
+	UseHttp          bool
+	AccessKey        string
+	SecretKey        string
+	Endpoint         string
+	Region           string
+	SignatureVersion string //SignatureV2 or SignatureV4
+	MaxIdleConns     int
+	Timeout          time.Duration //idle timeout of connections, 0 disables
+}
+
+const (
+	SchemeHttp  = "http"
+	SchemeHttps = "https"
+)
+
+// SplitEndpoint returns the host of endpoint and whether it's reached by
+// http. A "http://" or "https://" prefix of endpoint wins over scheme, which
+// wins over useHttp.
+func SplitEndpoint(endpoint string, scheme string, useHttp bool) (host string, http bool) {
+	switch {
+	case strings.HasPrefix(endpoint, "http://"):
+		return strings.TrimSuffix(strings.TrimPrefix(endpoint, "http://"), "/"), true
+	case strings.HasPrefix(endpoint, "https://"):
+		return strings.TrimSuffix(strings.TrimPrefix(endpoint, "https://"), "/"), false
+	case scheme != "":
+		return endpoint, scheme == SchemeHttp
+	}
+	return endpoint, useHttp
+}
+
+func GetS3Client(config S3ClientConfig) (client *s3.S3) {
 	var auth aws.Auth
 	var region aws.Region
 	var schema string
+	var transport http.RoundTripper
 
 	auth = aws.Auth{
-		AccessKey: accessKey,
-		SecretKey: secretKey,
+		AccessKey: config.AccessKey,
+		SecretKey: config.SecretKey,
 	}
 
-	if useHttp {
+	if config.UseHttp {
 		schema = "http"
 	} else {
 		schema = "https"
 	}
 
 	region = aws.Region{
-		Name:                 "squid1",                  //canonical name
-		S3Endpoint:           schema + "://" + endpoint, //address
+		Name:                 config.Region,                    //canonical name
+		S3Endpoint:           schema + "://" + config.Endpoint, //address
 		S3LocationConstraint: true,
 		S3LowercaseBucket:    true,
 	}
 
-	log.Printf("Connecting to %s...\n", region.S3Endpoint)
+	log.Printf("Connecting to %s (signature %s, region %s)...\n", region.S3Endpoint, config.SignatureVersion, region.Name)
 
-	maxIdleConns := maxRoutineSize
 	connectTimeout := 1 * time.Second
 
-	httpClient := &http.Client{
-		Timeout: 5 * time.Second,
-		Transport: &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			DialContext: (&net.Dialer{
-				Timeout:   connectTimeout,
-				KeepAlive: 30 * time.Minute,
-			}).DialContext,
-			MaxIdleConns:          maxIdleConns,
-			IdleConnTimeout:       30 * time.Minute,
-			TLSHandshakeTimeout:   10 * time.Second,
-			ExpectContinueTimeout: 1 * time.Second,
-		}}
+	dialer := &net.Dialer{
+		Timeout:   connectTimeout,
+		KeepAlive: 30 * time.Minute,
+	}
+
+	transport = &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+			conn, err = dialer.DialContext(ctx, network, addr)
+			if err != nil || config.Timeout <= 0 {
+				return
+			}
+			conn = &idleTimeoutConn{Conn: conn, timeout: config.Timeout}
+			return
+		},
+		//objects stored with Content-Encoding: gzip are copied as they are,
+		//not decompressed without their Content-Encoding and Content-Length
+		DisableCompression:    true,
+		MaxIdleConns:          config.MaxIdleConns,
+		IdleConnTimeout:       30 * time.Minute,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	if config.SignatureVersion == SignatureV4 {
+		transport = &v4Transport{auth: auth, region: config.Region, service: "s3", next: transport}
+	}
+
+	httpClient := &http.Client{Transport: transport}
 
 	client = s3.New(auth, region)
 	client.HTTPClient = func() *http.Client {
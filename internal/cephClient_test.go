@@ -0,0 +1,52 @@
+package internal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestGetS3ClientKeepsContentEncoding(t *testing.T) {
+	var stored bytes.Buffer
+	writer := gzip.NewWriter(&stored)
+	writer.Write([]byte("body { color: red }"))
+	writer.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Length", strconv.Itoa(stored.Len()))
+		w.Write(stored.Bytes())
+	}))
+	defer server.Close()
+
+	client := GetS3Client(S3ClientConfig{
+		UseHttp:          true,
+		AccessKey:        "a",
+		SecretKey:        "b",
+		Endpoint:         strings.TrimPrefix(server.URL, "http://"),
+		SignatureVersion: SignatureV2,
+	})
+
+	resp, err := client.Bucket("b").GetResponse("a.css")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Header.Get("Content-Encoding") != "gzip" || resp.Header.Get("Content-Length") != strconv.Itoa(stored.Len()) {
+		t.Errorf("headers %v", resp.Header)
+	}
+	if !bytes.Equal(body, stored.Bytes()) {
+		t.Errorf("body %q, expected the stored gzip", body)
+	}
+}
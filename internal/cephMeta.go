@@ -1,32 +1,45 @@
 package internal
 
 import (
-	"bytes"
+	"context"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"github.com/mitchellh/goamz/s3"
-	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strconv"
-	"time"
 )
 
 var NotSuccessHttpStatusError = errors.New("url returned not 200")
 var NotImplementedAclMappingError = errors.New("mapping not implemented")
 
-func tryFromUrl(u *url.URL, sourceS3Bucket *s3.Bucket) (fmeta FileMeta, err error) {
+// HttpStatusError is returned when the source responds with a status other
+// than 200. It matches NotSuccessHttpStatusError with errors.Is.
+type HttpStatusError struct {
+	StatusCode int
+}
+
+func (e *HttpStatusError) Error() string {
+	return fmt.Sprintf("%s: %d %s", NotSuccessHttpStatusError, e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+func (e *HttpStatusError) Is(target error) bool {
+	return target == NotSuccessHttpStatusError
+}
+
+func tryFromUrl(ctx context.Context, u *url.URL, destinationKey string, sourceS3Bucket *s3.Bucket, types *ContentTypes) (fmeta FileMeta, err error) {
 	key := u.Path
 
-	resp, err := sourceS3Bucket.GetResponse(key)
+	resp, err := doRequest(ctx, sourceS3Bucket, "GET", key, nil, nil, nil, 0)
 
 	if err != nil {
 		return
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		err = NotSuccessHttpStatusError
+		resp.Body.Close()
+		err = &HttpStatusError{StatusCode: resp.StatusCode}
 		return
 	}
 
@@ -35,90 +48,76 @@ func tryFromUrl(u *url.URL, sourceS3Bucket *s3.Bucket) (fmeta FileMeta, err erro
 	filesize, err := strconv.ParseInt(resp.Header.Get("content-length"), 10, 0)
 
 	if filesize == 0 {
-		err = fmt.Errorf("%+v; size: %d", FileInvalidSizeError, filesize)
+		err = fmt.Errorf("%w; size: %d", FileInvalidSizeError, filesize)
 		return
 	}
 
-	contentType := resp.Header.Get("content-type")
-
-	if contentType == "text/plain" || contentType == "" {
-		var buf, _ = ioutil.ReadAll(resp.Body)
-		contentType, err = getContentType(bytes.NewBuffer(buf))
-
-		if err != nil {
-			err = fmt.Errorf("%+v size: %d; err: %+v", MimeTypeNotRecognizedError, filesize, err)
-			return
-		}
-
-		fmeta.Reader = ioutil.NopCloser(bytes.NewReader(buf))
-	}
+	contentType, mimeSource, err := types.Resolve(destinationKey, resp.Header.Get("content-type"), func() (contentType string, err error) {
+		contentType, fmeta.Reader, err = getContentType(resp.Body)
+		return
+	})
 
-	if contentType == "" {
-		err = fmt.Errorf("%+v size: %d", MimeTypeNotRecognizedError, filesize)
+	if err != nil {
+		err = fmt.Errorf("%w size: %d; err: %+v", MimeTypeNotRecognizedError, filesize, err)
 		return
 	}
 
-	acl, err := getAcl(sourceS3Bucket, key, u)
-
-	if err != nil {
+	if contentType == "" {
+		err = fmt.Errorf("%w size: %d", MimeTypeNotRecognizedError, filesize)
 		return
 	}
 
 	fmeta.Filesize = filesize
 	fmeta.Mimetype = contentType
-	fmeta.Acl = acl
+	fmeta.MimeSource = mimeSource
+
+	err = setObjectMeta(ctx, &fmeta, sourceS3Bucket, key, resp.Header)
 
 	return
 }
 
-func getAcl(s3Bucket *s3.Bucket, key string, u *url.URL) (acl s3.ACL, err error) {
-	var cephAclResponse AccessControlPolicy
-	acl = s3.Private
-
-	params := make(map[string][]string)
-	params["acl"] = []string{""}
-	headers := make(map[string][]string)
-	headers["Host"] = []string{s3Bucket.S3.S3BucketEndpoint}
-	headers["Date"] = []string{time.Now().In(time.UTC).Format(time.RFC1123)}
-
-	toSignString := key
-	if toSignString[0:1] != "/" {
-		toSignString = "/" + toSignString
-	}
-
-	toSignString = "/" + s3Bucket.Name + toSignString
+// setObjectMeta sets the acl, etag, mtime and headers of the source object
+// key with the response header of it.
+func setObjectMeta(ctx context.Context, fmeta *FileMeta, sourceS3Bucket *s3.Bucket, key string, header http.Header) (err error) {
+	policy, err := getAclPolicy(ctx, sourceS3Bucket, key)
 
-	sign(s3Bucket.S3.Auth, "GET", toSignString, params, headers)
-
-	z := s3Bucket.URL(key)
-	u, _ = url.Parse(z)
-	u.RawQuery = "acl"
-	hreq := http.Request{
-		URL:        u,
-		Method:     "GET",
-		ProtoMajor: 1,
-		ProtoMinor: 1,
-		Close:      true,
-		Header:     headers,
-	}
-	ok, err := s3Bucket.HTTPClient().Do(&hreq)
 	if err != nil {
 		return
 	}
 
-	if ok.StatusCode != http.StatusOK {
-		err = NotSuccessHttpStatusError
-		return
+	fmeta.Acl = cannedAcl(policy)
+	fmeta.AclPolicy = &policy
+	fmeta.SourceEtag = NormalizeEtag(header.Get("ETag"))
+	fmeta.Headers = metadataOfResponse(header)
+	fmeta.SourceType = header.Get("Content-Type")
+
+	fmeta.Mtime = parseMtime(header)
+	if fmeta.Mtime.IsZero() {
+		fmeta.Mtime, _ = http.ParseTime(header.Get("Last-Modified"))
 	}
 
-	decoder := xml.NewDecoder(ok.Body)
+	return
+}
 
-	err = decoder.Decode(&cephAclResponse)
+func getAclPolicy(ctx context.Context, s3Bucket *s3.Bucket, key string) (policy AccessControlPolicy, err error) {
+	resp, err := doRequest(ctx, s3Bucket, "GET", key, url.Values{"acl": {""}}, nil, nil, 0)
 	if err != nil {
 		return
 	}
 
-	for _, g := range cephAclResponse.AccessControlList.Grants {
+	defer resp.Body.Close()
+
+	err = xml.NewDecoder(resp.Body).Decode(&policy)
+
+	return
+}
+
+// cannedAcl maps the policy to a canned ACL. Policies which can't be
+// expressed by one give an empty ACL.
+func cannedAcl(policy AccessControlPolicy) (acl s3.ACL) {
+	acl = s3.Private
+
+	for _, g := range policy.AccessControlList.Grants {
 		if g.Gruntee.URI == "http://acs.amazonaws.com/groups/global/AllUsers" {
 			if g.Permission == "READ" {
 				acl = s3.PublicRead
@@ -131,15 +130,15 @@ func getAcl(s3Bucket *s3.Bucket, key string, u *url.URL) (acl s3.ACL, err error)
 		}
 
 		if g.Gruntee.URI == "http://acs.amazonaws.com/groups/global/AuthenticatedUsers" {
-			err = NotImplementedAclMappingError
+			acl = ""
 		}
 
 		if g.Gruntee.URI == "http://acs.amazonaws.com/groups/s3/LogDelivery" {
-			err = NotImplementedAclMappingError
+			acl = ""
 		}
 
 		if g.Permission == "FULL_CONTROL" && g.Gruntee.URI != "" {
-			err = NotImplementedAclMappingError
+			acl = ""
 		}
 
 	}
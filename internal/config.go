@@ -0,0 +1,385 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+var InvalidConfigError = errors.New("invalid config file")
+
+// LoadConfig reads the config file at name and returns its settings keyed
+// by flag name. The file is TOML; values are strings, numbers, booleans or
+// arrays of them, an array sets a repeatable flag once per element:
+//
+//	# settings for every run
+//	c = 40
+//
+//	[prod]
+//	destination-endpoint = "s3.example.com"
+//	destination-signature = "v4"
+//	key-rule = ['s#^/var/www##', "lowercase"]
+//
+// Top level settings are always used, settings of the table named profile
+// override them. Tables named by endpointProfiles, keyed by "source" or
+// "destination", hold EndpointSettings which are set for that side only,
+// over the others. Other tables are ignored.
+func LoadConfig(name string, profile string, endpointProfiles map[string]string) (values map[string][]string, err error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return
+	}
+
+	tables, err := parseConfig(string(data))
+	if err != nil {
+		err = fmt.Errorf("%s: %w", name, err)
+		return
+	}
+
+	table := func(profile string) (settings map[string][]string, err error) {
+		settings, ok := tables[profile]
+		if !ok {
+			err = fmt.Errorf("profile %q not found in %s", profile, name)
+		}
+		return
+	}
+
+	values = make(map[string][]string)
+
+	for k, v := range tables[""] {
+		values[k] = v
+	}
+
+	if profile != "" {
+		var settings map[string][]string
+		if settings, err = table(profile); err != nil {
+			return
+		}
+		for k, v := range settings {
+			values[k] = v
+		}
+	}
+
+	for side, profile := range endpointProfiles {
+		if profile == "" {
+			continue
+		}
+
+		var settings map[string][]string
+		if settings, err = table(profile); err != nil {
+			return
+		}
+		for k, v := range settings {
+			if !isEndpointSetting(k) {
+				err = fmt.Errorf("setting %q of profile %q is not one of %s", k, profile, strings.Join(EndpointSettings, ", "))
+				return
+			}
+			values[side+"-"+k] = v
+		}
+	}
+
+	return
+}
+
+// EndpointSettings are the settings of a source or destination profile.
+var EndpointSettings = []string{"endpoint", "bucket", "access-key", "secret-key", "region", "signature", "scheme", "http-timeout"}
+
+func isEndpointSetting(name string) bool {
+	for _, setting := range EndpointSettings {
+		if name == setting {
+			return true
+		}
+	}
+	return false
+}
+
+// configParser reads the part of TOML a flat list of settings needs: tables
+// with a single name, keys which aren't dotted, and strings, numbers,
+// booleans and arrays of them. Everything else is an error rather than
+// silently misread.
+type configParser struct {
+	data   string
+	pos    int
+	line   int
+	tables map[string]map[string][]string
+}
+
+var (
+	bareKey      = regexp.MustCompile(`^[A-Za-z0-9_-]+`)
+	configNumber = regexp.MustCompile(`^[+-]?([0-9][0-9_]*(\.[0-9][0-9_]*)?([eE][+-]?[0-9][0-9_]*)?|0x[0-9A-Fa-f_]+|0o[0-7_]+|0b[01_]+)$`)
+)
+
+// parseConfig returns the settings of data by table, top level settings are
+// in the table "".
+func parseConfig(data string) (tables map[string]map[string][]string, err error) {
+	p := &configParser{data: data, line: 1, tables: map[string]map[string][]string{"": {}}}
+	table := ""
+
+	for {
+		p.skipBlank(true)
+		if p.pos == len(p.data) {
+			return p.tables, nil
+		}
+
+		if p.data[p.pos] == '[' {
+			if table, err = p.table(); err != nil {
+				return
+			}
+		} else if err = p.setting(table); err != nil {
+			return
+		}
+
+		if err = p.endOfLine(); err != nil {
+			return
+		}
+	}
+}
+
+func (p *configParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: line %d: %s", InvalidConfigError, p.line, fmt.Sprintf(format, args...))
+}
+
+// skipBlank skips spaces and comments, and newlines too if newlines is set.
+func (p *configParser) skipBlank(newlines bool) {
+	for p.pos < len(p.data) {
+		switch c := p.data[p.pos]; {
+		case c == ' ' || c == '\t' || c == '\r':
+			p.pos++
+		case c == '#':
+			for p.pos < len(p.data) && p.data[p.pos] != '\n' {
+				p.pos++
+			}
+		case c == '\n' && newlines:
+			p.pos++
+			p.line++
+		default:
+			return
+		}
+	}
+}
+
+func (p *configParser) endOfLine() error {
+	p.skipBlank(false)
+	if p.pos < len(p.data) && p.data[p.pos] != '\n' {
+		return p.errorf("unexpected %q after the value", p.rest())
+	}
+	return nil
+}
+
+// rest returns the rest of the current line for error messages.
+func (p *configParser) rest() string {
+	rest := p.data[p.pos:]
+	if i := strings.IndexByte(rest, '\n'); i >= 0 {
+		rest = rest[:i]
+	}
+	return strings.TrimSpace(rest)
+}
+
+func (p *configParser) table() (name string, err error) {
+	p.pos++
+	if p.pos < len(p.data) && p.data[p.pos] == '[' {
+		return "", p.errorf("arrays of tables are not supported")
+	}
+
+	p.skipBlank(false)
+	if name, err = p.key(); err != nil {
+		return
+	}
+
+	p.skipBlank(false)
+	if p.pos == len(p.data) || p.data[p.pos] != ']' {
+		return "", p.errorf("expected ] after table %q", name)
+	}
+	p.pos++
+
+	if _, ok := p.tables[name]; ok {
+		return "", p.errorf("table %q is defined twice", name)
+	}
+	p.tables[name] = make(map[string][]string)
+
+	return
+}
+
+func (p *configParser) setting(table string) (err error) {
+	key, err := p.key()
+	if err != nil {
+		return
+	}
+
+	p.skipBlank(false)
+	if p.pos == len(p.data) || p.data[p.pos] != '=' {
+		return p.errorf("expected = after %q", key)
+	}
+	p.pos++
+	p.skipBlank(false)
+
+	var values []string
+	if p.pos < len(p.data) && p.data[p.pos] == '[' {
+		values, err = p.array()
+	} else {
+		var value string
+		value, err = p.value()
+		values = []string{value}
+	}
+	if err != nil {
+		return
+	}
+
+	if _, ok := p.tables[table][key]; ok {
+		return p.errorf("%q is set twice", key)
+	}
+	p.tables[table][key] = values
+
+	return
+}
+
+func (p *configParser) key() (key string, err error) {
+	if p.pos < len(p.data) && (p.data[p.pos] == '"' || p.data[p.pos] == '\'') {
+		key, err = p.str()
+	} else if key = bareKey.FindString(p.data[p.pos:]); key == "" {
+		return "", p.errorf("expected a key, got %q", p.rest())
+	} else {
+		p.pos += len(key)
+	}
+	if err != nil {
+		return
+	}
+
+	if p.pos < len(p.data) && p.data[p.pos] == '.' {
+		return "", p.errorf("dotted keys are not supported")
+	}
+
+	return
+}
+
+func (p *configParser) array() (values []string, err error) {
+	p.pos++
+	values = []string{}
+
+	for {
+		p.skipBlank(true)
+		if p.pos == len(p.data) {
+			return nil, p.errorf("unterminated array")
+		}
+		if p.data[p.pos] == ']' {
+			p.pos++
+			return
+		}
+
+		var value string
+		if value, err = p.value(); err != nil {
+			return
+		}
+		values = append(values, value)
+
+		p.skipBlank(true)
+		if p.pos < len(p.data) && p.data[p.pos] == ',' {
+			p.pos++
+		} else if p.pos < len(p.data) && p.data[p.pos] != ']' {
+			return nil, p.errorf("expected , or ] in array, got %q", p.rest())
+		}
+	}
+}
+
+// value reads a string, number or boolean and returns it as text.
+func (p *configParser) value() (value string, err error) {
+	if p.pos == len(p.data) {
+		return "", p.errorf("missing value")
+	}
+
+	switch p.data[p.pos] {
+	case '"', '\'':
+		return p.str()
+	case '[':
+		return "", p.errorf("nested arrays are not supported")
+	case '{':
+		return "", p.errorf("inline tables are not supported")
+	}
+
+	end := p.pos
+	for end < len(p.data) && strings.IndexByte(" \t\r\n#,]", p.data[end]) < 0 {
+		end++
+	}
+	value = p.data[p.pos:end]
+
+	switch {
+	case value == "true" || value == "false":
+	case configNumber.MatchString(value):
+		value = strings.ReplaceAll(value, "_", "")
+	default:
+		return "", p.errorf("invalid value %q, strings must be quoted", value)
+	}
+
+	p.pos = end
+	return
+}
+
+// str reads a basic "..." or literal '...' string on a single line.
+func (p *configParser) str() (value string, err error) {
+	quote := p.data[p.pos]
+	if strings.HasPrefix(p.data[p.pos:], strings.Repeat(string(quote), 3)) {
+		return "", p.errorf("multi-line strings are not supported")
+	}
+	p.pos++
+
+	var b strings.Builder
+	for p.pos < len(p.data) {
+		c := p.data[p.pos]
+		switch {
+		case c == quote:
+			p.pos++
+			return b.String(), nil
+		case c == '\n':
+			return "", p.errorf("unterminated string")
+		case c == '\\' && quote == '"':
+			if err = p.escape(&b); err != nil {
+				return
+			}
+		default:
+			b.WriteByte(c)
+			p.pos++
+		}
+	}
+
+	return "", p.errorf("unterminated string")
+}
+
+func (p *configParser) escape(b *strings.Builder) error {
+	if p.pos+1 == len(p.data) {
+		return p.errorf("unterminated string")
+	}
+
+	c := p.data[p.pos+1]
+	p.pos += 2
+
+	if simple := strings.IndexByte(`btnfr"\`, c); simple >= 0 {
+		b.WriteByte("\b\t\n\f\r\"\\"[simple])
+		return nil
+	}
+
+	digits := 0
+	switch c {
+	case 'u':
+		digits = 4
+	case 'U':
+		digits = 8
+	default:
+		return p.errorf("invalid escape \\%c", c)
+	}
+
+	if p.pos+digits > len(p.data) {
+		return p.errorf("invalid escape \\%c", c)
+	}
+	code, err := strconv.ParseUint(p.data[p.pos:p.pos+digits], 16, 32)
+	if err != nil || !utf8.ValidRune(rune(code)) {
+		return p.errorf("invalid escape \\%c%s", c, p.data[p.pos:p.pos+digits])
+	}
+	p.pos += digits
+	b.WriteRune(rune(code))
+
+	return nil
+}
@@ -0,0 +1,149 @@
+package internal
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+const testConfig = `# settings for every run
+c = 40
+use-http = true
+
+[prod]
+c = 2_0
+destination-endpoint = "s3.example.com" # the new cluster
+key-rule = [
+	's#^/var/www##', # the old layout
+	"lowercase",
+]
+
+[old]
+endpoint = 'old.example.com'
+"bucket" = "media"
+http-timeout = "30s"
+
+[new]
+endpoint = "new.example.com"
+signature = "v4"
+scheme = "http"
+
+[broken]
+c = 10
+`
+
+func TestLoadConfig(t *testing.T) {
+	file, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	file.WriteString(testConfig)
+	file.Close()
+
+	tests := []struct {
+		name             string
+		profile          string
+		endpointProfiles map[string]string
+		expected         map[string][]string
+		failed           bool
+	}{
+		{"top level", "", nil, map[string][]string{"c": {"40"}, "use-http": {"true"}}, false},
+		{"profile", "prod", nil, map[string][]string{
+			"c": {"20"}, "use-http": {"true"}, "destination-endpoint": {"s3.example.com"},
+			"key-rule": {"s#^/var/www##", "lowercase"},
+		}, false},
+		{
+			"endpoint profiles", "", map[string]string{"source": "old", "destination": "new"},
+			map[string][]string{
+				"c": {"40"}, "use-http": {"true"},
+				"source-endpoint": {"old.example.com"}, "source-bucket": {"media"}, "source-http-timeout": {"30s"},
+				"destination-endpoint": {"new.example.com"}, "destination-signature": {"v4"}, "destination-scheme": {"http"},
+			},
+			false,
+		},
+		{"endpoint profile over profile", "prod", map[string]string{"destination": "new"}, map[string][]string{
+			"c": {"20"}, "use-http": {"true"}, "key-rule": {"s#^/var/www##", "lowercase"},
+			"destination-endpoint": {"new.example.com"}, "destination-signature": {"v4"}, "destination-scheme": {"http"},
+		}, false},
+		{"missing profile", "missing", nil, nil, true},
+		{"missing endpoint profile", "", map[string]string{"source": "missing"}, nil, true},
+		{"not an endpoint setting", "", map[string]string{"source": "broken"}, nil, true},
+	}
+
+	for _, test := range tests {
+		values, err := LoadConfig(file.Name(), test.profile, test.endpointProfiles)
+
+		if test.failed {
+			if err == nil {
+				t.Errorf("%s: no error", test.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(values, test.expected) {
+			t.Errorf("%s: values %v, expected %v", test.name, values, test.expected)
+		}
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		data     string
+		expected map[string][]string
+		failed   bool
+	}{
+		{`a = "x # y" # z`, map[string][]string{"a": {"x # y"}}, false},
+		{`a = "tab\tquote\" \u00e9"`, map[string][]string{"a": {"tab\tquote\" é"}}, false},
+		{`a = 'C:\path'`, map[string][]string{"a": {`C:\path`}}, false},
+		{"a = 1_000\nb = -1.5e3\nc = false", map[string][]string{"a": {"1000"}, "b": {"-1.5e3"}, "c": {"false"}}, false},
+		{`a = []`, map[string][]string{"a": {}}, false},
+		{`a = [1, "two"]`, map[string][]string{"a": {"1", "two"}}, false},
+		{"a = [\n1,\n2 # two\n]", map[string][]string{"a": {"1", "2"}}, false},
+		{`a = s3.example.com`, nil, true},
+		{`a = 2024-01-01`, nil, true},
+		{`a = "unterminated`, nil, true},
+		{`a = "\x41"`, nil, true},
+		{`a = """multi"""`, nil, true},
+		{`a = [[1]]`, nil, true},
+		{`a = {b = 1}`, nil, true},
+		{`a = [1 2]`, nil, true},
+		{`a = [1`, nil, true},
+		{`a = "x" "y"`, nil, true},
+		{`a.b = 1`, nil, true},
+		{`a =`, nil, true},
+		{`= 1`, nil, true},
+		{"a = 1\na = 2", nil, true},
+		{"[t]\n[t]", nil, true},
+		{"[[t]]", nil, true},
+		{"[t", nil, true},
+	}
+
+	for _, test := range tests {
+		tables, err := parseConfig(test.data)
+
+		if test.failed {
+			if !errors.Is(err, InvalidConfigError) {
+				t.Errorf("%q: error %v, expected InvalidConfigError", test.data, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: %v", test.data, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(tables[""], test.expected) {
+			t.Errorf("%q: settings %v, expected %v", test.data, tables[""], test.expected)
+		}
+	}
+}
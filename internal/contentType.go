@@ -0,0 +1,175 @@
+package internal
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	MimeSourceOverride  = "override"  //a -content-type rule
+	MimeSourceObject    = "source"    //the type of the source object
+	MimeSourceExtension = "extension" //the extension of the key
+	MimeSourceSniff     = "sniff"     //the content
+	MimeSourceDefault   = "default"
+
+	sniffUnknown = "application/octet-stream" //sniffed when nothing is recognized
+)
+
+// types clients set when they don't know better, they don't hide the type of
+// the extension
+var genericTypes = map[string]bool{
+	"application/octet-stream": true,
+	"binary/octet-stream":      true,
+	"text/plain":               true,
+}
+
+var InvalidContentTypeRuleError = errors.New("invalid content type rule")
+
+// types of common extensions, a mime.types file adds to them
+var defaultExtensions = map[string]string{
+	".css":   "text/css; charset=utf-8",
+	".csv":   "text/csv; charset=utf-8",
+	".eot":   "application/vnd.ms-fontobject",
+	".gif":   "image/gif",
+	".gz":    "application/gzip",
+	".htm":   "text/html; charset=utf-8",
+	".html":  "text/html; charset=utf-8",
+	".ico":   "image/vnd.microsoft.icon",
+	".jpeg":  "image/jpeg",
+	".jpg":   "image/jpeg",
+	".js":    "text/javascript; charset=utf-8",
+	".json":  "application/json",
+	".map":   "application/json",
+	".md":    "text/markdown; charset=utf-8",
+	".mjs":   "text/javascript; charset=utf-8",
+	".mp3":   "audio/mpeg",
+	".mp4":   "video/mp4",
+	".otf":   "font/otf",
+	".pdf":   "application/pdf",
+	".png":   "image/png",
+	".svg":   "image/svg+xml",
+	".ttf":   "font/ttf",
+	".txt":   "text/plain; charset=utf-8",
+	".wasm":  "application/wasm",
+	".webm":  "video/webm",
+	".webp":  "image/webp",
+	".woff":  "font/woff",
+	".woff2": "font/woff2",
+	".xml":   "text/xml; charset=utf-8",
+	".zip":   "application/zip",
+}
+
+type ContentTypeRule struct {
+	Pattern string
+	Type    string
+}
+
+// ParseContentTypeRule parses "pattern=type". Patterns match keys like the
+// ones of AclRules.
+func ParseContentTypeRule(s string) (rule ContentTypeRule, err error) {
+	pattern, contentType, ok := strings.Cut(s, "=")
+	if !ok || pattern == "" || contentType == "" {
+		err = fmt.Errorf("%w: %q is not pattern=type", InvalidContentTypeRuleError, s)
+		return
+	}
+
+	if _, err = path.Match(pattern, ""); err != nil {
+		err = fmt.Errorf("%w: %q: %v", InvalidContentTypeRuleError, pattern, err)
+		return
+	}
+
+	rule.Pattern = pattern
+	rule.Type = contentType
+
+	return
+}
+
+// ContentTypes resolve the content type of an upload, the first of: the type
+// of the first rule matching the key, the type of the source object unless
+// it's empty or generic, the type of the extension of the key, the sniffed
+// type unless nothing is recognized, the default type and the generic type of
+// the source object.
+type ContentTypes struct {
+	Rules      []ContentTypeRule
+	Extensions map[string]string //lowercase extension with the dot to type
+	Default    string
+}
+
+func NewContentTypes() *ContentTypes {
+	t := &ContentTypes{Extensions: make(map[string]string)}
+	for ext, contentType := range defaultExtensions {
+		t.Extensions[ext] = contentType
+	}
+	return t
+}
+
+// LoadMimeTypes adds the types of a mime.types file: lines of a type followed
+// by its extensions, like "text/css css". Lines starting with # are skipped.
+func (t *ContentTypes) LoadMimeTypes(name string) (err error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		for _, ext := range fields[1:] {
+			t.Extensions["."+strings.ToLower(strings.TrimPrefix(ext, "."))] = fields[0]
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Resolve returns the type of key and where it comes from. sniff reads the
+// type of the content, it may be nil if the content can't be read.
+func (t *ContentTypes) Resolve(key string, objectType string, sniff func() (string, error)) (contentType string, from string, err error) {
+	for _, rule := range t.Rules {
+		if matchKey(rule.Pattern, key) {
+			return rule.Type, MimeSourceOverride, nil
+		}
+	}
+
+	if objectType != "" && !isGenericType(objectType) {
+		return objectType, MimeSourceObject, nil
+	}
+
+	if contentType, ok := t.Extensions[strings.ToLower(path.Ext(key))]; ok {
+		return contentType, MimeSourceExtension, nil
+	}
+
+	if sniff != nil {
+		if contentType, err = sniff(); err != nil {
+			return
+		}
+		if contentType != "" && (contentType != sniffUnknown || t.Default == "") {
+			return contentType, MimeSourceSniff, nil
+		}
+	}
+
+	if t.Default != "" {
+		return t.Default, MimeSourceDefault, nil
+	}
+
+	if objectType != "" {
+		return objectType, MimeSourceObject, nil
+	}
+
+	return "", "", nil
+}
+
+// isGenericType reports whether contentType is one of genericTypes, with
+// parameters like a charset or not.
+func isGenericType(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	return genericTypes[strings.ToLower(strings.TrimSpace(mediaType))]
+}
@@ -0,0 +1,67 @@
+package internal
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestContentTypesResolve(t *testing.T) {
+	types := NewContentTypes()
+	types.Rules = []ContentTypeRule{{"*.map", "application/x-map"}, {"docs/", "text/x-doc"}}
+
+	sniffed := func(contentType string) func() (string, error) {
+		return func() (string, error) { return contentType, nil }
+	}
+
+	tests := []struct {
+		name        string
+		key         string
+		objectType  string
+		sniff       func() (string, error)
+		defaultType string
+		expected    string
+		from        string
+	}{
+		{"rule over the object", "a.map", "application/json", nil, "", "application/x-map", MimeSourceOverride},
+		{"rule of a directory", "docs/a/b.png", "", nil, "", "text/x-doc", MimeSourceOverride},
+		{"object over the extension", "a.png", "image/webp", nil, "", "image/webp", MimeSourceObject},
+		{"text/plain object", "a.png", "text/plain", nil, "", "image/png", MimeSourceExtension},
+		{"text/plain with a charset", "a.png", "text/plain; charset=utf-8", nil, "", "image/png", MimeSourceExtension},
+		{"application/octet-stream object", "a.png", "application/octet-stream", nil, "", "image/png", MimeSourceExtension},
+		{"binary/octet-stream object", "a.PNG", "Binary/Octet-Stream", nil, "", "image/png", MimeSourceExtension},
+		{"extension", "a.css", "", nil, "", "text/css; charset=utf-8", MimeSourceExtension},
+		{"sniffed", "a", "", sniffed("image/gif"), "", "image/gif", MimeSourceSniff},
+		{"sniffed over a generic object", "a", "binary/octet-stream", sniffed("image/gif"), "", "image/gif", MimeSourceSniff},
+		{"unknown sniffed", "a", "", sniffed(sniffUnknown), "", sniffUnknown, MimeSourceSniff},
+		{"default over unknown sniffed", "a", "", sniffed(sniffUnknown), "text/x-default", "text/x-default", MimeSourceDefault},
+		{"default over a generic object", "a", "text/plain", nil, "text/x-default", "text/x-default", MimeSourceDefault},
+		{"generic object last", "a", "binary/octet-stream", nil, "", "binary/octet-stream", MimeSourceObject},
+		{"nothing", "a", "", nil, "", "", ""},
+	}
+
+	for _, test := range tests {
+		types.Default = test.defaultType
+
+		contentType, from, err := types.Resolve(test.key, test.objectType, test.sniff)
+		if err != nil || contentType != test.expected || from != test.from {
+			t.Errorf("%s: %q from %q, error %v", test.name, contentType, from, err)
+		}
+	}
+
+	if _, _, err := types.Resolve("a", "", func() (string, error) { return "", errors.New("read failed") }); err == nil {
+		t.Error("sniff error not returned")
+	}
+}
+
+func TestParseContentTypeRule(t *testing.T) {
+	rule, err := ParseContentTypeRule("*.map=application/json")
+	if err != nil || rule.Pattern != "*.map" || rule.Type != "application/json" {
+		t.Errorf("%+v, %v", rule, err)
+	}
+
+	for _, s := range []string{"*.map", "=application/json", "*.map=", "[=text/plain"} {
+		if _, err = ParseContentTypeRule(s); !errors.Is(err, InvalidContentTypeRuleError) {
+			t.Errorf("%q: error %v", s, err)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package internal
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/mitchellh/goamz/s3"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	MaxCopySize = 5 * 1024 * 1024 * 1024 //larger objects are copied by parts
+
+	MetadataDirectiveCopy    = "COPY"
+	MetadataDirectiveReplace = "REPLACE"
+)
+
+var InvalidMetadataDirectiveError = errors.New("metadata directive must be COPY or REPLACE")
+
+// copyResult is the body of CopyObjectResult and CopyPartResult responses.
+// Copies may fail after the 200 status is sent, then the body is an Error.
+type copyResult struct {
+	XMLName xml.Name
+	ETag    string `xml:"ETag"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// NewCopyMeta reads the meta of the source object name like NewMeta, but
+// with a HEAD request, for a copy on the server or a plan. The content type
+// is resolved without sniffing.
+func NewCopyMeta(ctx context.Context, name string, destinationKey string, sourceS3Bucket *s3.Bucket, types *ContentTypes) (fmeta FileMeta, err error) {
+	u, err := url.Parse(name)
+	if err != nil {
+		return
+	}
+
+	header, err := HeadObject(ctx, sourceS3Bucket, u.Path)
+	if err != nil {
+		return
+	}
+
+	fmeta.Filesize, err = strconv.ParseInt(header.Get("Content-Length"), 10, 0)
+	if fmeta.Filesize == 0 {
+		err = fmt.Errorf("%w; size: %d", FileInvalidSizeError, fmeta.Filesize)
+		return
+	}
+
+	fmeta.Mimetype, fmeta.MimeSource, _ = types.Resolve(destinationKey, header.Get("Content-Type"), nil)
+	if fmeta.Mimetype == "" {
+		err = fmt.Errorf("%w size: %d", MimeTypeNotRecognizedError, fmeta.Filesize)
+		return
+	}
+
+	err = setObjectMeta(ctx, &fmeta, sourceS3Bucket, u.Path, header)
+
+	return
+}
+
+// CopyObject copies sourceKey of source to key of destination on the same
+// cluster without reading the content. With MetadataDirectiveReplace the
+// object gets headers, otherwise the metadata of the source. Objects larger
+// than MaxCopySize are copied with UploadPartCopy by concurrency goroutines,
+// then headers are always set, and no more parts are copied once ctx is done.
+// The returned etag is the one s3 is expected to assign to the object,
+// destinationEtag is the one it did.
+func CopyObject(ctx context.Context, destination *s3.Bucket, key string, source *s3.Bucket, sourceKey string, size int64, headers http.Header, directive string, partSize int64, concurrency int) (etag string, destinationEtag string, err error) {
+	copySource := amazonEscape("/" + source.Name + "/" + strings.TrimLeft(sourceKey, "/"))
+
+	if size > MaxCopySize {
+		return copyParts(ctx, destination, key, copySource, size, headers, partSize, concurrency)
+	}
+
+	headers = headers.Clone()
+	headers.Set("X-Amz-Copy-Source", copySource)
+	headers.Set("X-Amz-Metadata-Directive", directive)
+
+	if directive == MetadataDirectiveCopy {
+		//the acl isn't metadata and is always taken from the request
+		for name := range headers {
+			if name != "X-Amz-Copy-Source" && name != "X-Amz-Metadata-Directive" && !isAclHeader(name) {
+				headers.Del(name)
+			}
+		}
+	}
+
+	destinationEtag, err = requestCopy(ctx, destination, key, nil, headers)
+
+	return
+}
+
+// KeepSourceMetadata returns the headers and the directive of a copy of
+// fmeta which keeps the metadata of the source, with headers of an upload.
+// Without a stored mtime sync couldn't compare the copy, so the metadata of
+// the source is then set again with the mtime by MetadataDirectiveReplace.
+func KeepSourceMetadata(headers http.Header, fmeta FileMeta) (copyHeaders http.Header, directive string) {
+	if fmeta.Headers.Get(MtimeHeader) != "" || fmeta.Mtime.IsZero() {
+		return headers, MetadataDirectiveCopy
+	}
+
+	copyHeaders = fmeta.Headers.Clone()
+	if fmeta.SourceType != "" {
+		copyHeaders.Set("Content-Type", fmeta.SourceType)
+	}
+	copyHeaders.Set(MtimeHeader, FormatMtime(fmeta.Mtime))
+
+	//the acl isn't metadata and is always taken from the request
+	for name, values := range headers {
+		if isAclHeader(name) {
+			copyHeaders[name] = values
+		}
+	}
+
+	return copyHeaders, MetadataDirectiveReplace
+}
+
+// copyParts copies by parts the way PutMultipart uploads.
+func copyParts(ctx context.Context, destination *s3.Bucket, key string, copySource string, size int64, headers http.Header, partSize int64, concurrency int) (etag string, destinationEtag string, err error) {
+	var (
+		multi *s3.Multi
+		parts []s3.Part
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+	)
+
+	if partSize < MinPartSize {
+		err = fmt.Errorf("%w: %d", PartSizeTooSmallError, partSize)
+		return
+	}
+
+	for size/partSize >= maxParts {
+		partSize *= 2
+	}
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	count := int((size + partSize - 1) / partSize)
+	partSums := make([][]byte, count)
+
+	multi, err = initMulti(ctx, destination, key, headers)
+	if err != nil {
+		return
+	}
+
+	pool := make(chan bool, concurrency)
+
+	fail := func(e error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err == nil {
+			err = e
+		}
+	}
+
+	for n := 1; n <= count; n++ {
+		pool <- true
+
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			fail(ctxErr)
+		}
+
+		mu.Lock()
+		failed := err != nil
+		mu.Unlock()
+		if failed {
+			<-pool
+			break
+		}
+
+		start := int64(n-1) * partSize
+		end := start + partSize - 1
+		if end >= size {
+			end = size - 1
+		}
+
+		wg.Add(1)
+		go func(n int, start int64, end int64) {
+			defer func() {
+				<-pool
+				wg.Done()
+			}()
+
+			partHeaders := make(http.Header)
+			partHeaders.Set("X-Amz-Copy-Source", copySource)
+			partHeaders.Set("X-Amz-Copy-Source-Range", fmt.Sprintf("bytes=%d-%d", start, end))
+
+			params := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {multi.UploadId}}
+
+			partEtag, copyErr := requestCopy(ctx, destination, key, params, partHeaders)
+			if copyErr != nil {
+				fail(fmt.Errorf("part %d: %w", n, copyErr))
+				return
+			}
+
+			sum, decodeErr := hex.DecodeString(NormalizeEtag(partEtag))
+			if decodeErr != nil {
+				fail(fmt.Errorf("part %d: etag %s: %w", n, partEtag, decodeErr))
+				return
+			}
+
+			mu.Lock()
+			parts = append(parts, s3.Part{N: n, ETag: partEtag, Size: end - start + 1})
+			partSums[n-1] = sum
+			mu.Unlock()
+		}(n, start, end)
+	}
+
+	wg.Wait()
+
+	if err == nil {
+		err = multi.Complete(parts)
+	}
+
+	if err != nil {
+		multi.Abort()
+		return
+	}
+
+	etag = MultipartEtag(partSums)
+
+	header, err := HeadObject(ctx, destination, key)
+	if err != nil {
+		return
+	}
+	destinationEtag = header.Get("ETag")
+
+	return
+}
+
+// requestCopy sends a copy request and returns the ETag of the result.
+func requestCopy(ctx context.Context, bucket *s3.Bucket, key string, params url.Values, headers http.Header) (etag string, err error) {
+	resp, err := doRequest(ctx, bucket, "PUT", key, params, headers, nil, 0)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+
+	var result copyResult
+	if err = xml.Unmarshal(body, &result); err != nil {
+		return
+	}
+
+	if result.XMLName.Local == "Error" {
+		err = &s3.Error{StatusCode: resp.StatusCode, Code: result.Code, Message: result.Message}
+		return
+	}
+
+	etag = result.ETag
+
+	return
+}
+
+func isAclHeader(name string) bool {
+	return name == "X-Amz-Acl" || strings.HasPrefix(name, "X-Amz-Grant-")
+}
@@ -0,0 +1,47 @@
+package internal
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestKeepSourceMetadata(t *testing.T) {
+	mtime := time.Unix(1600000000, 0)
+	headers := http.Header{
+		"Content-Type":     {"text/plain"},
+		"Cache-Control":    {"no-cache"},
+		"X-Amz-Acl":        {"private"},
+		"X-Amz-Meta-Mtime": {FormatMtime(mtime)},
+	}
+
+	//the stored mtime is copied with the metadata
+	fmeta := FileMeta{
+		Mtime:      mtime,
+		SourceType: "text/css",
+		Headers:    http.Header{"Cache-Control": {"max-age=60"}, MtimeHeader: {FormatMtime(mtime)}},
+	}
+	if copyHeaders, directive := KeepSourceMetadata(headers, fmeta); directive != MetadataDirectiveCopy || copyHeaders.Get("Cache-Control") != "no-cache" {
+		t.Errorf("%s with %v", directive, copyHeaders)
+	}
+
+	//the source metadata is set again with the mtime of Last-Modified
+	fmeta.Headers = http.Header{"Cache-Control": {"max-age=60"}, "X-Amz-Meta-Owner": {"web"}}
+	copyHeaders, directive := KeepSourceMetadata(headers, fmeta)
+
+	expected := http.Header{
+		"Content-Type":     {"text/css"},
+		"Cache-Control":    {"max-age=60"},
+		"X-Amz-Meta-Owner": {"web"},
+		"X-Amz-Acl":        {"private"},
+		MtimeHeader:        {FormatMtime(mtime)},
+	}
+	if directive != MetadataDirectiveReplace || len(copyHeaders) != len(expected) {
+		t.Fatalf("%s with %v", directive, copyHeaders)
+	}
+	for name := range expected {
+		if copyHeaders.Get(name) != expected.Get(name) {
+			t.Errorf("%s: %q, expected %q", name, copyHeaders.Get(name), expected.Get(name))
+		}
+	}
+}
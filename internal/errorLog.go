@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const errorLogSeparator = " ### "
+
+// ErrorLogEntry is a single line of the error log.
+type ErrorLogEntry struct {
+	Time       string
+	SourceLine string
+	Error      string
+	Class      ErrorClass
+	KeySource  string //what the key was mapped from, the source line if not recorded
+}
+
+// FormatErrorLogLine returns the error log line for err raised while
+// processing sourceLine: "time ### source line ### error ### class". The
+// key of the source line is mapped from keySource, which is appended as
+// " ### key source" if it's another string, as the relative path in -dir
+// mode and the key in -list-source mode.
+func FormatErrorLogLine(t time.Time, sourceLine string, keySource string, err error) string {
+	line := fmt.Sprintf("%s ### %s ### %s ### %s", t, sourceLine, err, ClassifyError(err))
+	if keySource != "" && keySource != sourceLine {
+		line += errorLogSeparator + keySource
+	}
+	return line + "\n"
+}
+
+// ParseErrorLogLine parses a line written by FormatErrorLogLine. Lines
+// written before the class was recorded have no class and get
+// ErrorClassUnknown.
+func ParseErrorLogLine(line string) (entry ErrorLogEntry, ok bool) {
+	fields := strings.Split(strings.TrimRight(line, "\r\n"), errorLogSeparator)
+
+	if len(fields) < 3 {
+		return
+	}
+
+	entry.Time = fields[0]
+	entry.SourceLine = fields[1]
+	entry.KeySource = fields[1]
+	entry.Class = ErrorClassUnknown
+
+	//a key source follows the class
+	errorFields := fields[2:]
+	if len(errorFields) > 2 && ErrorClass(errorFields[len(errorFields)-2]).Valid() {
+		entry.KeySource = errorFields[len(errorFields)-1]
+		errorFields = errorFields[:len(errorFields)-1]
+	}
+
+	//the class is the last field, but only if it's one we know
+	if len(errorFields) > 1 {
+		last := ErrorClass(errorFields[len(errorFields)-1])
+		if last.Valid() {
+			entry.Class = last
+			errorFields = errorFields[:len(errorFields)-1]
+		}
+	}
+
+	entry.Error = strings.Join(errorFields, errorLogSeparator)
+	ok = true
+
+	return
+}
+
+// ReadErrorLog returns the entries of the error log at name whose class is
+// one of classes and whose error matches match. Empty classes and nil match
+// accept everything. Every source line is returned only once.
+func ReadErrorLog(name string, classes []ErrorClass, match *regexp.Regexp) (entries []ErrorLogEntry, err error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		entry, ok := ParseErrorLogLine(scanner.Text())
+
+		if !ok || entry.SourceLine == "" || seen[entry.SourceLine] {
+			continue
+		}
+
+		if len(classes) > 0 && !hasClass(classes, entry.Class) {
+			continue
+		}
+
+		if match != nil && !match.MatchString(entry.Error) {
+			continue
+		}
+
+		seen[entry.SourceLine] = true
+		entries = append(entries, entry)
+	}
+
+	err = scanner.Err()
+
+	return
+}
+
+// ParseErrorClasses parses a comma separated list of error classes.
+func ParseErrorClasses(list string) (classes []ErrorClass, err error) {
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		class := ErrorClass(name)
+		if !class.Valid() {
+			err = fmt.Errorf("unknown error class %q", name)
+			return
+		}
+
+		classes = append(classes, class)
+	}
+
+	return
+}
+
+func hasClass(classes []ErrorClass, class ErrorClass) bool {
+	for _, c := range classes {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestErrorLogLineRoundTrip(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		sourceLine string
+		keySource  string
+		err        error
+		class      ErrorClass
+	}{
+		{"/var/www/a.png", "/var/www/a.png", ChecksumMismatchError, ErrorClassChecksum},
+		{"http://host/b.png?x=1", "http://host/b.png?x=1", errors.New("odd"), ErrorClassUnknown},
+		{"c.png", "c.png", errors.New("a ### separator in the error"), ErrorClassUnknown},
+		{"d.png", "d.png", FileInvalidSizeError, ErrorClassInvalid},
+		{"/var/www/static/e.png", "static/e.png", ChecksumMismatchError, ErrorClassChecksum},
+		{SourceLineOfKey("f g?.png"), "f g?.png", errors.New("a ### separator in the error"), ErrorClassUnknown},
+	}
+
+	for _, test := range tests {
+		line := FormatErrorLogLine(now, test.sourceLine, test.keySource, test.err)
+
+		entry, ok := ParseErrorLogLine(line)
+		if !ok {
+			t.Errorf("%q not parsed", line)
+			continue
+		}
+
+		if entry.Time != now.String() || entry.SourceLine != test.sourceLine || entry.Error != test.err.Error() || entry.Class != test.class || entry.KeySource != test.keySource {
+			t.Errorf("%q parsed to %+v", line, entry)
+		}
+	}
+}
+
+func TestParseErrorLogLine(t *testing.T) {
+	tests := []struct {
+		line  string
+		ok    bool
+		entry ErrorLogEntry
+	}{
+		{"t ### a.png ### failed\n", true, ErrorLogEntry{"t", "a.png", "failed", ErrorClassUnknown, "a.png"}},
+		{"t ### a.png ### failed ### network", true, ErrorLogEntry{"t", "a.png", "failed", ErrorClassNetwork, "a.png"}},
+		{"t ### a.png ### failed ### not a class", true, ErrorLogEntry{"t", "a.png", "failed ### not a class", ErrorClassUnknown, "a.png"}},
+		{"t ### /abs/a.png ### failed ### network ### a.png", true, ErrorLogEntry{"t", "/abs/a.png", "failed", ErrorClassNetwork, "a.png"}},
+		{"t ### a.png ### x ### failed ### network ### b", true, ErrorLogEntry{"t", "a.png", "x ### failed", ErrorClassNetwork, "b"}},
+		{"t ### a.png", false, ErrorLogEntry{}},
+		{"", false, ErrorLogEntry{}},
+	}
+
+	for _, test := range tests {
+		entry, ok := ParseErrorLogLine(test.line)
+		if ok != test.ok || entry != test.entry {
+			t.Errorf("%q parsed to %+v, %v", test.line, entry, ok)
+		}
+	}
+}
+
+func TestReadErrorLog(t *testing.T) {
+	file, err := ioutil.TempFile("", "errorlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	file.WriteString("t ### a.png ### timeout ### network\n")
+	file.WriteString("t ### b.png ### denied ### access\n")
+	file.WriteString("t ### a.png ### timeout again ### network\n")
+	file.WriteString("garbage\n")
+	file.WriteString("t ### c.png ### reset by peer ### network\n")
+	file.Close()
+
+	entries, err := ReadErrorLog(file.Name(), []ErrorClass{ErrorClassNetwork}, regexp.MustCompile("timeout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 || entries[0].SourceLine != "a.png" {
+		t.Errorf("entries %+v", entries)
+	}
+
+	entries, err = ReadErrorLog(file.Name(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 3 {
+		t.Errorf("%d entries, expected 3", len(entries))
+	}
+}
+
+func TestParseErrorClasses(t *testing.T) {
+	classes, err := ParseErrorClasses("network, server,,")
+	if err != nil || len(classes) != 2 || classes[0] != ErrorClassNetwork || classes[1] != ErrorClassServer {
+		t.Errorf("classes %v, error %v", classes, err)
+	}
+
+	if _, err = ParseErrorClasses("network,bogus"); err == nil {
+		t.Error("unknown class accepted")
+	}
+}
@@ -0,0 +1,96 @@
+package internal
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LogFormatText = "text"
+	LogFormatJson = "json"
+
+	EventStart    = "start"
+	EventDone     = "done"
+	EventSkipped  = "skipped" //unchanged in sync mode
+	EventPlanned  = "planned" //dry run
+	EventFailed   = "failed"
+	EventProgress = "progress"
+	EventSummary  = "summary"
+	EventLog      = "log" //any other log line
+)
+
+// Event is a single line of the JSON log.
+type Event struct {
+	Time       time.Time `json:"time"`
+	Event      string    `json:"event"`
+	Source     string    `json:"source,omitempty"`
+	KeySource  string    `json:"key_source,omitempty"` //what Key is mapped from, if it's not Source
+	Key        string    `json:"key,omitempty"`
+	Size       int64     `json:"size,omitempty"`
+	Duration   float64   `json:"duration,omitempty"` //seconds
+	Mime       string    `json:"mime,omitempty"`
+	MimeSource string    `json:"mime_source,omitempty"` //override, source, extension, sniff or default
+	Acl        string    `json:"acl,omitempty"`
+	Attempts   int       `json:"attempts,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Class      string    `json:"class,omitempty"`
+	Message    string    `json:"message,omitempty"`
+	Err        error     `json:"-"` //of failed events
+
+	//progress and summary
+	Processed   uint64  `json:"processed,omitempty"`
+	Total       uint64  `json:"total,omitempty"`
+	Skipped     uint64  `json:"skipped,omitempty"`
+	Failed      uint64  `json:"failed,omitempty"`
+	Transferred uint64  `json:"transferred,omitempty"` //bytes
+	InProgress  uint64  `json:"in_progress,omitempty"`
+	TotalBytes  uint64  `json:"total_bytes,omitempty"` //known after a prescan
+	Percent     float64 `json:"percent,omitempty"`
+	Rate        float64 `json:"rate,omitempty"`         //bytes per second since the last progress event
+	AverageRate float64 `json:"average_rate,omitempty"` //bytes per second over the last minute
+	Eta         float64 `json:"eta,omitempty"`          //seconds
+	Version     string  `json:"version,omitempty"`
+}
+
+// EventWriter writes events as JSON lines.
+type EventWriter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func NewEventWriter(w io.Writer) *EventWriter {
+	return &EventWriter{enc: json.NewEncoder(w)}
+}
+
+// Write writes e, with the current time if it has none.
+func (w *EventWriter) Write(e Event) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.enc.Encode(e)
+}
+
+// LogWriter returns a writer for log.SetOutput which writes every log
+// line as an EventLog event.
+func (w *EventWriter) LogWriter() io.Writer {
+	return logEventWriter{w}
+}
+
+type logEventWriter struct {
+	events *EventWriter
+}
+
+func (w logEventWriter) Write(p []byte) (n int, err error) {
+	message := strings.TrimSpace(strings.TrimPrefix(string(p), "~"))
+	if err = w.events.Write(Event{Event: EventLog, Message: message}); err == nil {
+		n = len(p)
+	}
+	return
+}
@@ -2,41 +2,38 @@ package internal
 
 import (
 	"fmt"
-	"github.com/mitchellh/goamz/s3"
 	"os"
 )
 
-func tryFromFile(name string) (fmeta FileMeta, err error) {
+func tryFromFile(name string, destinationKey string, types *ContentTypes) (fmeta FileMeta, err error) {
 
 	file, err := os.Open(name)
 	if err != nil {
 		return
 	}
 
-	_fileInfo, err := os.Stat(name)
+	fmeta.Reader = file
+
+	_fileInfo, err := file.Stat()
 	if err != nil {
 		return
 	}
 
-	fmeta.Reader = file
 	fmeta.Filesize = _fileInfo.Size()
-	fmeta.Acl = s3.PublicRead
+	fmeta.Mtime = _fileInfo.ModTime()
 
-	f, err := os.Open(name)
-	if err != nil {
+	fmeta.Mimetype, fmeta.MimeSource, err = types.Resolve(destinationKey, "", func() (contentType string, err error) {
+		contentType, fmeta.Reader, err = getContentType(file)
 		return
-	}
-	defer f.Close()
-
-	fmeta.Mimetype, err = getContentType(f)
+	})
 
 	if err != nil {
-		err = fmt.Errorf("%+v filesize: %d, err: %+v", MimeTypeNotRecognizedError, fmeta.Filesize, err)
+		err = fmt.Errorf("%w filesize: %d, err: %+v", MimeTypeNotRecognizedError, fmeta.Filesize, err)
 		return
 	}
 
 	if fmeta.Mimetype == "" {
-		err = fmt.Errorf("%+v filesize: %d", MimeTypeNotRecognizedError, fmeta.Filesize)
+		err = fmt.Errorf("%w filesize: %d", MimeTypeNotRecognizedError, fmeta.Filesize)
 		return
 	}
 
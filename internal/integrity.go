@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/mitchellh/goamz/s3"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var ChecksumMismatchError = errors.New("checksum mismatch")
+
+// Md5Reader computes the md5 of everything read through it.
+type Md5Reader struct {
+	reader io.Reader
+	hash   hash.Hash
+}
+
+func NewMd5Reader(r io.Reader) *Md5Reader {
+	return &Md5Reader{reader: r, hash: md5.New()}
+}
+
+func (r *Md5Reader) Read(p []byte) (n int, err error) {
+	n, err = r.reader.Read(p)
+	r.hash.Write(p[:n])
+	return
+}
+
+// Sum returns the hex encoded md5 of the data read so far.
+func (r *Md5Reader) Sum() string {
+	return hex.EncodeToString(r.hash.Sum(nil))
+}
+
+// FileMd5 returns the hex encoded md5 of the file.
+func FileMd5(name string) (sum string, err error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	hash := md5.New()
+	if _, err = io.Copy(hash, file); err != nil {
+		return
+	}
+
+	sum = hex.EncodeToString(hash.Sum(nil))
+
+	return
+}
+
+// Md5Base64 converts a hex encoded md5 to the Content-MD5 header format.
+func Md5Base64(md5Hex string) string {
+	sum, err := hex.DecodeString(md5Hex)
+	if err != nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(sum)
+}
+
+// NormalizeEtag strips quotes of an ETag header.
+func NormalizeEtag(etag string) string {
+	return strings.ToLower(strings.Trim(etag, `"`))
+}
+
+// IsMultipartEtag reports whether etag belongs to an object uploaded in
+// parts. Such ETags are "<md5 of part md5s>-<part count>", not the md5 of
+// the content.
+func IsMultipartEtag(etag string) bool {
+	return strings.Contains(etag, "-")
+}
+
+// MultipartEtag returns the ETag s3 assigns to a multipart upload of parts
+// with the given binary md5 sums.
+func MultipartEtag(partSums [][]byte) string {
+	hash := md5.New()
+	for _, sum := range partSums {
+		hash.Write(sum)
+	}
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(hash.Sum(nil)), len(partSums))
+}
+
+// VerifyUpload checks the md5 of the uploaded stream against the md5 known
+// before the upload and the source ETag, and the ETag returned by the
+// destination against the expected one. Empty values are not checked, nor
+// are multipart source ETags which can't be compared with the content md5.
+func VerifyUpload(streamMd5 string, knownMd5 string, sourceEtag string, expectedEtag string, destinationEtag string) error {
+	sourceEtag = NormalizeEtag(sourceEtag)
+	expectedEtag = NormalizeEtag(expectedEtag)
+	destinationEtag = NormalizeEtag(destinationEtag)
+
+	if knownMd5 != "" && streamMd5 != knownMd5 {
+		return fmt.Errorf("%w: source md5 %s, read %s", ChecksumMismatchError, knownMd5, streamMd5)
+	}
+
+	if sourceEtag != "" && !IsMultipartEtag(sourceEtag) && streamMd5 != sourceEtag {
+		return fmt.Errorf("%w: source etag %s, read %s", ChecksumMismatchError, sourceEtag, streamMd5)
+	}
+
+	if destinationEtag != "" && expectedEtag != "" && destinationEtag != expectedEtag {
+		return fmt.Errorf("%w: expected etag %s, destination etag %s", ChecksumMismatchError, expectedEtag, destinationEtag)
+	}
+
+	return nil
+}
+
+// VerifySize checks the size of the object at key of bucket, for objects
+// whose ETag can't be compared with an expected one, as copies of sources
+// uploaded in parts.
+func VerifySize(ctx context.Context, bucket *s3.Bucket, key string, size int64) (err error) {
+	header, err := HeadObject(ctx, bucket, key)
+	if err != nil {
+		return
+	}
+
+	if length := header.Get("Content-Length"); length != strconv.FormatInt(size, 10) {
+		err = fmt.Errorf("%w: expected size %d, destination size %q", ChecksumMismatchError, size, length)
+	}
+
+	return
+}
@@ -0,0 +1,125 @@
+package internal
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+const helloMd5 = "5d41402abc4b2a76b9719d911017c592" //md5 of "hello"
+
+func TestMd5Reader(t *testing.T) {
+	long := strings.Repeat("hello", 10000)
+	longSum := md5.Sum([]byte(long))
+
+	tests := []struct {
+		data     string
+		expected string
+	}{
+		{"", "d41d8cd98f00b204e9800998ecf8427e"},
+		{"hello", helloMd5},
+		{long, hex.EncodeToString(longSum[:])},
+	}
+
+	for _, test := range tests {
+		r := NewMd5Reader(strings.NewReader(test.data))
+
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(data) != test.data {
+			t.Errorf("%d bytes read, expected %d", len(data), len(test.data))
+		}
+
+		if sum := r.Sum(); sum != test.expected {
+			t.Errorf("md5 of %d bytes %s, expected %s", len(test.data), sum, test.expected)
+		}
+	}
+}
+
+func TestMd5Base64(t *testing.T) {
+	tests := []struct {
+		md5Hex   string
+		expected string
+	}{
+		{helloMd5, "XUFAKrxLKna5cZ2REBfFkg=="},
+		{"d41d8cd98f00b204e9800998ecf8427e", "1B2M2Y8AsgTpgAmY7PhCfg=="},
+		{"not hex", ""},
+		{"5d4", ""},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		if actual := Md5Base64(test.md5Hex); actual != test.expected {
+			t.Errorf("Md5Base64(%q) = %q, expected %q", test.md5Hex, actual, test.expected)
+		}
+	}
+}
+
+func TestVerifyUpload(t *testing.T) {
+	const (
+		other     = "00000000000000000000000000000000"
+		multipart = "a0c2e2d8d8a9c5f8b3b1e2a7f1d4c3b2-3"
+	)
+
+	tests := []struct {
+		name            string
+		streamMd5       string
+		knownMd5        string
+		sourceEtag      string
+		expectedEtag    string
+		destinationEtag string
+		failed          bool
+	}{
+		{"nothing to check", helloMd5, "", "", "", "", false},
+		{"quoted etags", helloMd5, helloMd5, `"` + helloMd5 + `"`, helloMd5, `"` + helloMd5 + `"`, false},
+		{"unquoted etags", helloMd5, helloMd5, helloMd5, helloMd5, helloMd5, false},
+		{"upper case etags", helloMd5, "", `"` + strings.ToUpper(helloMd5) + `"`, helloMd5, strings.ToUpper(helloMd5), false},
+		{"known md5 mismatch", other, helloMd5, "", "", "", true},
+		{"source etag mismatch", other, "", `"` + helloMd5 + `"`, "", "", true},
+		{"multipart source etag", helloMd5, "", `"` + multipart + `"`, helloMd5, helloMd5, false},
+		{"multipart expected etag", helloMd5, "", "", multipart, `"` + multipart + `"`, false},
+		{"destination mismatch", helloMd5, "", "", helloMd5, `"` + other + `"`, true},
+		{"multipart destination mismatch", helloMd5, "", "", multipart, other, true},
+		{"no destination etag", helloMd5, "", "", helloMd5, "", false},
+		{"no expected etag", helloMd5, "", "", "", other, false},
+		{"copy", "", "", "", `"` + helloMd5 + `"`, helloMd5, false},
+		{"copy mismatch", "", "", "", helloMd5, other, true},
+	}
+
+	for _, test := range tests {
+		err := VerifyUpload(test.streamMd5, test.knownMd5, test.sourceEtag, test.expectedEtag, test.destinationEtag)
+
+		if test.failed && !errors.Is(err, ChecksumMismatchError) {
+			t.Errorf("%s: error %v, expected ChecksumMismatchError", test.name, err)
+		} else if !test.failed && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+	}
+}
+
+func TestVerifySize(t *testing.T) {
+	f := newFakeS3()
+	defer f.Close()
+
+	f.objects["/b/a"] = []byte("hello")
+	bucket := f.bucket("b")
+
+	if err := VerifySize(context.Background(), bucket, "a", 5); err != nil {
+		t.Errorf("same size: %v", err)
+	}
+
+	if err := VerifySize(context.Background(), bucket, "a", 6); !errors.Is(err, ChecksumMismatchError) {
+		t.Errorf("other size: error %v, expected ChecksumMismatchError", err)
+	}
+
+	if err := VerifySize(context.Background(), bucket, "missing", 5); err == nil || errors.Is(err, ChecksumMismatchError) {
+		t.Errorf("missing object: error %v", err)
+	}
+}
@@ -0,0 +1,204 @@
+package internal
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// journalUploaded ends records of lines uploaded in move mode whose source
+// is not deleted yet.
+const journalUploaded = " uploaded"
+
+// journalStarted starts the record of the time of the first run.
+const journalStarted = "started "
+
+// Journal is an append-only record of input lines which were uploaded
+// successfully. Every line is keyed by its number and a hash of its content,
+// so completions may be recorded in any order and a changed input file does
+// not skip lines by mistake.
+type Journal struct {
+	mu       sync.Mutex
+	file     *os.File
+	done     map[string]bool
+	uploaded map[string]bool //in move mode, sources still to delete
+	started  time.Time
+}
+
+// OpenJournal opens the journal at name. If resume is set, completed lines
+// are loaded from the existing journal, otherwise the journal is truncated.
+func OpenJournal(name string, resume bool) (j *Journal, err error) {
+	flags := os.O_RDWR | os.O_CREATE
+	if !resume {
+		flags |= os.O_TRUNC
+	}
+
+	file, err := os.OpenFile(name, flags, 0666)
+	if err != nil {
+		return
+	}
+
+	j = &Journal{file: file, done: make(map[string]bool), uploaded: make(map[string]bool)}
+
+	if resume {
+		err = j.load()
+		if err != nil {
+			file.Close()
+			j = nil
+			return
+		}
+	}
+
+	return
+}
+
+func (j *Journal) load() (err error) {
+	var size int64 //of the complete records
+
+	reader := bufio.NewReader(j.file)
+
+	for {
+		line, readErr := reader.ReadString('\n')
+
+		//a record without a newline was cut by a crash and is ignored
+		if strings.HasSuffix(line, "\n") {
+			record := strings.TrimSuffix(line, "\n")
+			if strings.HasPrefix(record, journalStarted) {
+				if seconds, parseErr := strconv.ParseInt(strings.TrimPrefix(record, journalStarted), 10, 64); parseErr == nil {
+					j.started = time.Unix(seconds, 0)
+				}
+			} else if strings.HasSuffix(record, journalUploaded) {
+				j.uploaded[strings.TrimSuffix(record, journalUploaded)] = true
+			} else {
+				j.done[record] = true
+			}
+			size += int64(len(line))
+		}
+
+		if readErr == io.EOF {
+			break
+		} else if readErr != nil {
+			return readErr
+		}
+	}
+
+	//new records replace a cut one, so it isn't read as complete later
+	if err = j.file.Truncate(size); err != nil {
+		return
+	}
+
+	_, err = j.file.Seek(size, io.SeekStart)
+
+	return
+}
+
+// JournalKey returns the journal key of the input line with the given number.
+func JournalKey(lineNumber uint64, line string) string {
+	sum := sha1.Sum([]byte(line))
+	return fmt.Sprintf("%d %s", lineNumber, hex.EncodeToString(sum[:]))
+}
+
+// Started returns the time of the first run of the journal, which resumed
+// runs keep. If no time is recorded yet, now is recorded.
+func (j *Journal) Started(now time.Time) (started time.Time, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if !j.started.IsZero() {
+		return j.started, nil
+	}
+
+	now = time.Unix(now.Unix(), 0)
+	if _, err = j.file.WriteString(journalStarted + strconv.FormatInt(now.Unix(), 10) + "\n"); err != nil {
+		return
+	}
+
+	j.started = now
+	started = now
+
+	return
+}
+
+// Count returns the number of completed lines loaded from the journal.
+func (j *Journal) Count() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return len(j.done)
+}
+
+// IsDone reports whether the line with key was recorded as completed.
+func (j *Journal) IsDone(key string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.done[key]
+}
+
+// IsUploaded reports whether the line with key was recorded as uploaded by
+// MarkUploaded but not completed.
+func (j *Journal) IsUploaded(key string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.uploaded[key] && !j.done[key]
+}
+
+// MarkDone records the line with key as completed. Every record is written
+// straight to the file, so it survives a crash of the process.
+func (j *Journal) MarkDone(key string) (err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.done[key] {
+		return
+	}
+
+	_, err = j.file.WriteString(key + "\n")
+	if err != nil {
+		return
+	}
+
+	j.done[key] = true
+
+	return
+}
+
+// MarkUploaded records that the line with key was uploaded, but its source
+// is not deleted yet. The line is completed by MarkDone once it is.
+func (j *Journal) MarkUploaded(key string) (err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.done[key] || j.uploaded[key] {
+		return
+	}
+
+	_, err = j.file.WriteString(key + journalUploaded + "\n")
+	if err != nil {
+		return
+	}
+
+	j.uploaded[key] = true
+
+	return
+}
+
+func (j *Journal) Close() (err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err = j.file.Sync(); err != nil {
+		j.file.Close()
+		return
+	}
+
+	return j.file.Close()
+}
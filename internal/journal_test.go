@@ -0,0 +1,183 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tempJournal(t *testing.T) (name string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "journal"), func() { os.RemoveAll(dir) }
+}
+
+func TestJournalKey(t *testing.T) {
+	if JournalKey(1, "a.txt") == JournalKey(2, "a.txt") {
+		t.Error("keys of different lines are equal")
+	}
+	if JournalKey(1, "a.txt") == JournalKey(1, "b.txt") {
+		t.Error("keys of different content are equal")
+	}
+	if JournalKey(1, "a.txt") != JournalKey(1, "a.txt") {
+		t.Error("keys of the same line differ")
+	}
+}
+
+func TestJournalResume(t *testing.T) {
+	name, cleanup := tempJournal(t)
+	defer cleanup()
+
+	first, second := JournalKey(1, "a.txt"), JournalKey(2, "b.txt")
+
+	j, err := OpenJournal(name, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = j.MarkDone(first); err != nil {
+		t.Fatal(err)
+	}
+	if err = j.MarkDone(first); err != nil {
+		t.Fatal(err)
+	}
+	if err = j.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	j, err = OpenJournal(name, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !j.IsDone(first) || j.IsDone(second) || j.Count() != 1 {
+		t.Errorf("loaded %d lines, first done %v, second done %v", j.Count(), j.IsDone(first), j.IsDone(second))
+	}
+	j.Close()
+
+	//without resume the journal starts over
+	j, err = OpenJournal(name, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.Count() != 0 {
+		t.Errorf("%d lines loaded without resume", j.Count())
+	}
+	j.Close()
+}
+
+func TestJournalTruncatedLastLine(t *testing.T) {
+	name, cleanup := tempJournal(t)
+	defer cleanup()
+
+	first, second, third := JournalKey(1, "a.txt"), JournalKey(2, "b.txt"), JournalKey(3, "c.txt")
+
+	//the record of the second line was cut by a crash
+	if err := ioutil.WriteFile(name, []byte(first+"\n"+second[:10]), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := OpenJournal(name, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !j.IsDone(first) || j.IsDone(second) || j.Count() != 1 {
+		t.Fatalf("loaded %d lines, first done %v, second done %v", j.Count(), j.IsDone(first), j.IsDone(second))
+	}
+	if err = j.MarkDone(third); err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+
+	//the record written after the cut one is on its own line
+	j, err = OpenJournal(name, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	if !j.IsDone(first) || !j.IsDone(third) || j.Count() != 2 {
+		t.Errorf("loaded %d lines, first done %v, third done %v", j.Count(), j.IsDone(first), j.IsDone(third))
+	}
+}
+
+func TestJournalUploaded(t *testing.T) {
+	name, cleanup := tempJournal(t)
+	defer cleanup()
+
+	first, second := JournalKey(1, "a.txt"), JournalKey(2, "b.txt")
+
+	j, err := OpenJournal(name, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = j.MarkUploaded(first); err != nil {
+		t.Fatal(err)
+	}
+	if err = j.MarkUploaded(second); err != nil {
+		t.Fatal(err)
+	}
+	if err = j.MarkDone(second); err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+
+	//the source of the first line is not deleted yet
+	j, err = OpenJournal(name, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	if j.IsDone(first) || !j.IsUploaded(first) || j.Count() != 1 {
+		t.Errorf("first done %v, uploaded %v, %d lines done", j.IsDone(first), j.IsUploaded(first), j.Count())
+	}
+	if !j.IsDone(second) || j.IsUploaded(second) {
+		t.Errorf("second done %v, uploaded %v", j.IsDone(second), j.IsUploaded(second))
+	}
+}
+
+func TestJournalStarted(t *testing.T) {
+	name, cleanup := tempJournal(t)
+	defer cleanup()
+
+	first := time.Unix(1600000000, 0)
+
+	j, err := OpenJournal(name, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if started, err := j.Started(first); err != nil || !started.Equal(first) {
+		t.Errorf("started %s, error %v", started, err)
+	}
+	if err = j.MarkDone(JournalKey(1, "a.txt")); err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+
+	//a resumed run keeps the time of the first one
+	j, err = OpenJournal(name, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if started, err := j.Started(first.Add(time.Hour)); err != nil || !started.Equal(first) {
+		t.Errorf("resumed started %s, error %v", started, err)
+	}
+	if j.Count() != 1 {
+		t.Errorf("%d lines loaded", j.Count())
+	}
+	j.Close()
+
+	//a new run starts over
+	j, err = OpenJournal(name, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	if started, err := j.Started(first.Add(time.Hour)); err != nil || !started.Equal(first.Add(time.Hour)) {
+		t.Errorf("new started %s, error %v", started, err)
+	}
+}
@@ -0,0 +1,276 @@
+package internal
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var InvalidKeyRuleError = errors.New("invalid key rule")
+var KeyMappingError = errors.New("key mapping failed")
+
+var placeholderRegexp = regexp.MustCompile(`\{([a-z0-9]+)(?::(\d+))?\}`)
+
+type keyRule struct {
+	source string
+	apply  func(key string, now time.Time) (string, error)
+}
+
+// KeyMapper turns source lines into destination keys by applying its
+// rules in order. Rules are:
+//
+//	s/regexp/replacement/[gi]  regexp replace, any delimiter may follow s
+//	remove:text                remove every occurrence of text
+//	prefix-add:text            add text at the start
+//	prefix-strip:text          remove text from the start
+//	strip-query                remove "?" and everything after it
+//	lowercase
+//	urldecode
+//	template:text              replace the key with text, where {key},
+//	                           {dir}, {base}, {ext}, {sha1}, {md5}, {sha1:N},
+//	                           {md5:N} (first N hex chars of the hash of the
+//	                           key), {yyyy}, {mm}, {dd} and {hh} (time of
+//	                           Now) are replaced
+type KeyMapper struct {
+	rules []keyRule
+	Now   func() time.Time //time of the placeholders, when the mapper was created by default
+}
+
+func NewKeyMapper(rules []string) (m *KeyMapper, err error) {
+	created := time.Now()
+	m = &KeyMapper{Now: func() time.Time { return created }}
+
+	for _, source := range rules {
+		var rule keyRule
+		if rule, err = parseKeyRule(source); err != nil {
+			m = nil
+			return
+		}
+		m.rules = append(m.rules, rule)
+	}
+
+	return
+}
+
+// Map returns the key of line.
+func (m *KeyMapper) Map(line string) (key string, err error) {
+	key = line
+	now := m.Now()
+
+	for _, rule := range m.rules {
+		if key, err = rule.apply(key, now); err != nil {
+			err = fmt.Errorf("%w: rule %q: %v", KeyMappingError, rule.source, err)
+			return
+		}
+	}
+
+	if key == "" || key == "/" {
+		err = fmt.Errorf("%w: empty key of %q", KeyMappingError, line)
+	}
+
+	return
+}
+
+// LoadKeyRules reads rules from the file at name, one per line. Empty lines
+// and lines starting with # are skipped.
+func LoadKeyRules(name string) (rules []string, err error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rules = append(rules, line)
+	}
+
+	err = scanner.Err()
+
+	return
+}
+
+func parseKeyRule(source string) (rule keyRule, err error) {
+	rule.source = source
+
+	name, arg, hasArg := strings.Cut(source, ":")
+
+	switch {
+	case len(source) > 1 && source[0] == 's' && !isRuleNameChar(source[1]):
+		rule.apply, err = parseReplaceRule(source)
+	case name == "remove" && hasArg && arg != "":
+		rule.apply = func(key string, now time.Time) (string, error) {
+			return strings.Replace(key, arg, "", -1), nil
+		}
+	case name == "prefix-add" && hasArg:
+		rule.apply = func(key string, now time.Time) (string, error) {
+			return arg + key, nil
+		}
+	case name == "prefix-strip" && hasArg:
+		rule.apply = func(key string, now time.Time) (string, error) {
+			return strings.TrimPrefix(key, arg), nil
+		}
+	case source == "strip-query":
+		rule.apply = func(key string, now time.Time) (string, error) {
+			if i := strings.Index(key, "?"); i >= 0 {
+				key = key[:i]
+			}
+			return key, nil
+		}
+	case source == "lowercase":
+		rule.apply = func(key string, now time.Time) (string, error) {
+			return strings.ToLower(key), nil
+		}
+	case source == "urldecode":
+		rule.apply = func(key string, now time.Time) (string, error) {
+			return url.PathUnescape(key)
+		}
+	case name == "template" && hasArg:
+		err = checkTemplate(arg)
+		rule.apply = func(key string, now time.Time) (string, error) {
+			return expandTemplate(arg, key, now), nil
+		}
+	default:
+		err = fmt.Errorf("%w: %q", InvalidKeyRuleError, source)
+	}
+
+	return
+}
+
+func isRuleNameChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == ':'
+}
+
+// parseReplaceRule parses s/regexp/replacement/flags. The delimiter may be
+// escaped with a backslash inside the regexp and the replacement.
+func parseReplaceRule(source string) (apply func(key string, now time.Time) (string, error), err error) {
+	delimiter := source[1]
+
+	var parts []string
+	var part strings.Builder
+
+	for i := 2; i < len(source); i++ {
+		c := source[i]
+		if c == '\\' && i+1 < len(source) && source[i+1] == delimiter {
+			part.WriteByte(delimiter)
+			i++
+			continue
+		}
+		if c == delimiter {
+			parts = append(parts, part.String())
+			part.Reset()
+			continue
+		}
+		part.WriteByte(c)
+	}
+
+	if len(parts) != 2 {
+		err = fmt.Errorf("%w: %q is not s/regexp/replacement/", InvalidKeyRuleError, source)
+		return
+	}
+
+	flags := part.String()
+	pattern, replacement := parts[0], parts[1]
+
+	if strings.Trim(flags, "gi") != "" {
+		err = fmt.Errorf("%w: unknown flags %q", InvalidKeyRuleError, flags)
+		return
+	}
+
+	if strings.Contains(flags, "i") {
+		pattern = "(?i)" + pattern
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		err = fmt.Errorf("%w: %v", InvalidKeyRuleError, err)
+		return
+	}
+
+	global := strings.Contains(flags, "g")
+
+	apply = func(key string, now time.Time) (string, error) {
+		if global {
+			return re.ReplaceAllString(key, replacement), nil
+		}
+
+		match := re.FindStringSubmatchIndex(key)
+		if match == nil {
+			return key, nil
+		}
+
+		expanded := re.ExpandString(nil, replacement, key, match)
+		return key[:match[0]] + string(expanded) + key[match[1]:], nil
+	}
+
+	return
+}
+
+func checkTemplate(template string) error {
+	for _, m := range placeholderRegexp.FindAllStringSubmatch(template, -1) {
+		switch m[1] {
+		case "key", "dir", "base", "ext", "yyyy", "mm", "dd", "hh":
+			if m[2] != "" {
+				return fmt.Errorf("%w: %s takes no length", InvalidKeyRuleError, m[0])
+			}
+		case "sha1", "md5":
+		default:
+			return fmt.Errorf("%w: unknown placeholder %s", InvalidKeyRuleError, m[0])
+		}
+	}
+	return nil
+}
+
+func expandTemplate(template string, key string, now time.Time) string {
+	return placeholderRegexp.ReplaceAllStringFunc(template, func(placeholder string) string {
+		m := placeholderRegexp.FindStringSubmatch(placeholder)
+
+		switch m[1] {
+		case "key":
+			return key
+		case "dir":
+			return path.Dir(key)
+		case "base":
+			return path.Base(key)
+		case "ext":
+			return path.Ext(key)
+		case "yyyy":
+			return now.Format("2006")
+		case "mm":
+			return now.Format("01")
+		case "dd":
+			return now.Format("02")
+		case "hh":
+			return now.Format("15")
+		}
+
+		var sum string
+		if m[1] == "sha1" {
+			h := sha1.Sum([]byte(key))
+			sum = hex.EncodeToString(h[:])
+		} else {
+			h := md5.Sum([]byte(key))
+			sum = hex.EncodeToString(h[:])
+		}
+
+		if n, err := strconv.Atoi(m[2]); err == nil && n < len(sum) {
+			sum = sum[:n]
+		}
+
+		return sum
+	})
+}
@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseKeyRule(t *testing.T) {
+	tests := []struct {
+		rule   string
+		failed bool
+	}{
+		{"s/a/b/", false},
+		{"s|a|b|gi", false},
+		{`s/a\/b/c/`, false},
+		{"s/a/b", true},
+		{"s/a/b/x", true},
+		{"s/(/b/", true},
+		{"remove:x", false},
+		{"remove:", true},
+		{"prefix-add:x/", false},
+		{"prefix-strip:/var/www", false},
+		{"strip-query", false},
+		{"lowercase", false},
+		{"urldecode", false},
+		{"template:{yyyy}/{md5:2}/{base}", false},
+		{"template:{unknown}", true},
+		{"template:{key:3}", true},
+		{"upcase", true},
+		{"s", true},
+	}
+
+	for _, test := range tests {
+		_, err := parseKeyRule(test.rule)
+		if (err != nil) != test.failed {
+			t.Errorf("%q: error %v", test.rule, err)
+		}
+		if err != nil && !errors.Is(err, InvalidKeyRuleError) {
+			t.Errorf("%q: error %v is not InvalidKeyRuleError", test.rule, err)
+		}
+	}
+}
+
+func TestKeyMapperMap(t *testing.T) {
+	now := time.Date(2021, 3, 4, 5, 6, 7, 0, time.Local)
+
+	tests := []struct {
+		rules    []string
+		line     string
+		expected string
+		failed   bool
+	}{
+		{nil, "/var/www/a.png", "/var/www/a.png", false},
+		{[]string{"prefix-strip:/var/www", "prefix-add:static"}, "/var/www/a.png", "static/a.png", false},
+		{[]string{"strip-query"}, "a.png?v=1", "a.png", false},
+		{[]string{"remove:_thumb"}, "a_thumb_thumb.png", "a.png", false},
+		{[]string{"lowercase", "urldecode"}, "A%20B.PNG", "a b.png", false},
+		{[]string{"urldecode"}, "a%zz.png", "", true},
+		{[]string{"s/a/b/"}, "aaa", "baa", false},
+		{[]string{"s/a/b/g"}, "aaa", "bbb", false},
+		{[]string{"s/A/b/gi"}, "aAa", "bbb", false},
+		{[]string{`s/(\w+)\.png/$1.webp/`}, "dir/a.png", "dir/a.webp", false},
+		{[]string{`s/\//-/g`}, "a/b/c", "a-b-c", false},
+		{[]string{"template:{dir}/{ext}/{base}"}, "img/a.png", "img/.png/a.png", false},
+		{[]string{"template:{yyyy}/{mm}/{dd}/{hh}/{key}"}, "a.png", "2021/03/04/05/a.png", false},
+		{[]string{"template:{md5:2}/{key}"}, "a.png", "32/a.png", false},
+		{[]string{"template:{sha1:4}"}, "a.png", "69ab", false},
+		{[]string{"template:{md5:100}"}, "", "d41d8cd98f00b204e9800998ecf8427e", false},
+		{[]string{"remove:a.png"}, "a.png", "", true},
+	}
+
+	for _, test := range tests {
+		m, err := NewKeyMapper(test.rules)
+		if err != nil {
+			t.Errorf("%v: %v", test.rules, err)
+			continue
+		}
+		m.Now = func() time.Time { return now }
+
+		key, err := m.Map(test.line)
+		if test.failed {
+			if !errors.Is(err, KeyMappingError) {
+				t.Errorf("%v %q: key %q, error %v", test.rules, test.line, key, err)
+			}
+			continue
+		}
+
+		if err != nil || key != test.expected {
+			t.Errorf("%v %q: key %q, expected %q, error %v", test.rules, test.line, key, test.expected, err)
+		}
+	}
+}
+
+func TestKeyMapperTimeIsFixed(t *testing.T) {
+	m, err := NewKeyMapper([]string{"template:{yyyy}{mm}{dd}{hh}/{key}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, _ := m.Map("a.png")
+	if second, _ := m.Map("a.png"); first != second || !m.Now().Equal(m.Now()) {
+		t.Errorf("keys %q and %q of the same line differ", first, second)
+	}
+}
+
+func TestLoadKeyRules(t *testing.T) {
+	file, err := ioutil.TempFile("", "rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	file.WriteString("# rules\nstrip-query\n\n  lowercase  \n")
+	file.Close()
+
+	rules, err := LoadKeyRules(file.Name())
+	if err != nil || len(rules) != 2 || rules[0] != "strip-query" || rules[1] != "lowercase" {
+		t.Errorf("rules %q, error %v", rules, err)
+	}
+}
@@ -0,0 +1,54 @@
+package internal
+
+import (
+	"github.com/mitchellh/goamz/s3"
+	"net/url"
+)
+
+const listPageSize = 1000
+
+// ListBucket calls fn for every object of bucket under prefix with a key
+// greater than marker, until fn returns false. Keys are listed page by page
+// as fn consumes them, failed page requests are retried with retry.
+func ListBucket(bucket *s3.Bucket, prefix string, marker string, retry RetryPolicy, fn func(key s3.Key) bool) (err error) {
+	for {
+		var resp *s3.ListResp
+
+		_, err = retry.Do(func() (err error) {
+			resp, err = bucket.List(prefix, "", marker, listPageSize)
+			return
+		})
+
+		if err != nil {
+			return
+		}
+
+		for _, key := range resp.Contents {
+			if !fn(key) {
+				return
+			}
+		}
+
+		if !resp.IsTruncated || len(resp.Contents) == 0 {
+			return
+		}
+
+		//NextMarker is returned only for listings with a delimiter
+		marker = resp.NextMarker
+		if marker == "" {
+			marker = resp.Contents[len(resp.Contents)-1].Key
+		}
+	}
+}
+
+// SourceLineOfKey returns the source line NewMeta reads the object with
+// key from. Keys are escaped only if they don't survive url parsing as is.
+func SourceLineOfKey(key string) string {
+	line := "/" + key
+
+	if u, err := url.Parse(line); err == nil && u.Path == line {
+		return line
+	}
+
+	return (&url.URL{Path: line}).String()
+}
@@ -1,24 +1,36 @@
 package internal
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"github.com/gabriel-vasile/mimetype"
 	"github.com/mitchellh/goamz/s3"
 	"io"
+	"net/http"
 	"net/url"
+	"time"
 )
 
 type FileMeta struct {
-	Reader   io.ReadCloser
-	Filesize int64
-	Mimetype string
-	Acl      s3.ACL
+	Reader     io.ReadCloser
+	Filesize   int64
+	Mimetype   string
+	MimeSource string               //where the type comes from, one of MimeSource*
+	Acl        s3.ACL               //empty if the grants of the source have no canned ACL
+	AclPolicy  *AccessControlPolicy //grants of the source object, nil for local files
+	SourceEtag string               //etag of the source object, empty for local files
+	Mtime      time.Time
+	Headers    http.Header //metadata of the source object kept on the copy
+	SourceType string      //content type of the source object as it is
 }
 
 var MimeTypeNotRecognizedError = errors.New("mime type not recognized")
 var FileInvalidSizeError = errors.New("filesize has a invalid size")
 
-func NewMeta(sourceIsS3 bool, name string, sourceS3Bucket *s3.Bucket) (fmeta FileMeta, err error) {
+// NewMeta opens the source name, which is uploaded to destinationKey with
+// the content type resolved by types.
+func NewMeta(ctx context.Context, sourceIsS3 bool, name string, destinationKey string, sourceS3Bucket *s3.Bucket, types *ContentTypes) (fmeta FileMeta, err error) {
 	var u *url.URL
 
 	if sourceIsS3 {
@@ -26,21 +38,42 @@ func NewMeta(sourceIsS3 bool, name string, sourceS3Bucket *s3.Bucket) (fmeta Fil
 		if err != nil {
 			return
 		}
-		fmeta, err = tryFromUrl(u, sourceS3Bucket)
+		fmeta, err = tryFromUrl(ctx, u, destinationKey, sourceS3Bucket, types)
 		return
 	}
 
-	fmeta, err = tryFromFile(name)
+	fmeta, err = tryFromFile(name, destinationKey, types)
 
 	return
 }
 
-func getContentType(reader io.Reader) (string, error) {
-	mime, err := mimetype.DetectReader(reader)
+// the head of a content read to detect its type, as much as mimetype reads
+const sniffLimit = 3072
+
+type peekedReader struct {
+	io.Reader
+	io.Closer
+}
+
+// getContentType detects the type of the content of rc by its head only and
+// returns a reader of the whole content: the head followed by the rest of rc.
+// content is returned on errors as well, to be closed.
+func getContentType(rc io.ReadCloser) (contentType string, content io.ReadCloser, err error) {
+	head := make([]byte, sniffLimit)
+
+	n, err := io.ReadFull(rc, head)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	head = head[:n]
+
+	content = peekedReader{io.MultiReader(bytes.NewReader(head), rc), rc}
 
 	if err != nil {
-		return "", err
+		return
 	}
 
-	return mime.String(), nil
+	contentType = mimetype.Detect(head).String()
+
+	return
 }
@@ -0,0 +1,88 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// closeRecorder is a body which records that it was closed.
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("read failed")
+}
+
+func TestGetContentType(t *testing.T) {
+	png := "\x89PNG\r\n\x1a\n"
+
+	tests := []struct {
+		name     string
+		body     string
+		expected string
+	}{
+		{"empty", "", "text/plain; charset=utf-8"},
+		{"shorter", png + "short", "image/png"},
+		{"exactly the head", png + strings.Repeat("a", sniffLimit-len(png)), "image/png"},
+		{"longer", png + strings.Repeat("a", 3*sniffLimit), "image/png"},
+		{"text longer", strings.Repeat("hello\n", sniffLimit), "text/plain; charset=utf-8"},
+	}
+
+	for _, test := range tests {
+		body := &closeRecorder{Reader: strings.NewReader(test.body)}
+
+		contentType, content, err := getContentType(body)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		if contentType != test.expected {
+			t.Errorf("%s: type %q, expected %q", test.name, contentType, test.expected)
+		}
+
+		data, err := ioutil.ReadAll(content)
+		if err != nil || !bytes.Equal(data, []byte(test.body)) {
+			t.Errorf("%s: %d bytes read of %d, %v", test.name, len(data), len(test.body), err)
+		}
+
+		if body.closed {
+			t.Errorf("%s: closed before the content was closed", test.name)
+		}
+
+		if err = content.Close(); err != nil || !body.closed {
+			t.Errorf("%s: close %v, body closed %v", test.name, err, body.closed)
+		}
+	}
+}
+
+func TestGetContentTypeError(t *testing.T) {
+	body := &closeRecorder{Reader: failingReader{}}
+
+	_, content, err := getContentType(body)
+	if err == nil {
+		t.Fatal("no error")
+	}
+
+	//returned to be closed
+	if content == nil {
+		t.Fatal("no content")
+	}
+
+	if content.Close(); !body.closed {
+		t.Error("body not closed")
+	}
+}
@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// copiedHeaders are the headers of a source object kept on the copy,
+// besides the x-amz-meta-* ones.
+var copiedHeaders = []string{
+	"Cache-Control",
+	"Content-Disposition",
+	"Content-Encoding",
+	"Content-Language",
+	"Expires",
+}
+
+// metadataOfResponse returns the headers of a source object response which
+// are stored with the object.
+func metadataOfResponse(header http.Header) (metadata http.Header) {
+	metadata = make(http.Header)
+
+	for _, name := range copiedHeaders {
+		if v := header.Get(name); v != "" {
+			metadata.Set(name, v)
+		}
+	}
+
+	for name, values := range header {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-meta-") {
+			metadata[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+
+	return
+}
+
+// MetadataRules select the copied headers and set headers of uploads.
+type MetadataRules struct {
+	Include  []string    //glob patterns of header names; copied headers must match one if set
+	Exclude  []string    //glob patterns of header names which are not copied
+	Override http.Header //set on every upload, an empty value removes the header
+}
+
+// ValidatePatterns returns an error for the first malformed pattern.
+func (r MetadataRules) ValidatePatterns() error {
+	for _, pattern := range append(append([]string{}, r.Include...), r.Exclude...) {
+		if _, err := path.Match(strings.ToLower(pattern), ""); err != nil {
+			return fmt.Errorf("%w: %q", err, pattern)
+		}
+	}
+	return nil
+}
+
+// Filter returns a copy of metadata with the headers accepted by the
+// include and exclude patterns.
+func (r MetadataRules) Filter(metadata http.Header) (filtered http.Header) {
+	filtered = make(http.Header)
+
+	for name, values := range metadata {
+		if len(r.Include) > 0 && !matchHeader(r.Include, name) {
+			continue
+		}
+		if matchHeader(r.Exclude, name) {
+			continue
+		}
+		filtered[name] = append([]string{}, values...)
+	}
+
+	return
+}
+
+// ApplyOverride sets the override headers on headers.
+func (r MetadataRules) ApplyOverride(headers http.Header) {
+	for name, values := range r.Override {
+		if len(values) == 0 || values[0] == "" {
+			headers.Del(name)
+			continue
+		}
+		headers[name] = values
+	}
+}
+
+// ParseHeaderOverride parses "Name=value" or "Name: value".
+func ParseHeaderOverride(s string) (name string, value string, err error) {
+	i := strings.IndexAny(s, "=:")
+	if i <= 0 {
+		err = fmt.Errorf("%q is not name=value", s)
+		return
+	}
+
+	name = http.CanonicalHeaderKey(strings.TrimSpace(s[:i]))
+	value = strings.TrimSpace(s[i+1:])
+
+	return
+}
+
+func matchHeader(patterns []string, name string) bool {
+	name = strings.ToLower(name)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,192 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const metricsPrefix = "s3uploader_"
+
+// Histogram counts observations in cumulative buckets like a prometheus
+// histogram.
+type Histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func NewHistogram(bounds ...float64) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *Histogram) write(w *bufio.Writer, name string, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	writeHeader(w, name, help, "histogram")
+	for i, bound := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(bound), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+type metricFunc struct {
+	name, help, kind string
+	value            func() float64
+}
+
+// Metrics collects the counters of a run and serves them in the prometheus
+// text format. Values kept elsewhere are added with Func. The zero value
+// is ready to use.
+type Metrics struct {
+	mu       sync.Mutex
+	funcs    []metricFunc
+	errors   map[ErrorClass]uint64
+	retries  uint64
+	inFlight int64
+
+	Duration *Histogram //seconds per upload, default buckets if nil
+	Size     *Histogram //bytes per upload, default buckets if nil
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{}
+	m.histograms()
+	return m
+}
+
+// histograms returns Duration and Size, made with the default buckets if
+// they are not set.
+func (m *Metrics) histograms() (duration *Histogram, size *Histogram) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.Duration == nil {
+		m.Duration = NewHistogram(0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300)
+	}
+
+	if m.Size == nil {
+		m.Size = NewHistogram(1<<10, 16<<10, 128<<10, 1<<20, 8<<20, 64<<20, 512<<20, 4<<30)
+	}
+
+	return m.Duration, m.Size
+}
+
+// Func adds a metric of kind "counter" or "gauge" read from value.
+func (m *Metrics) Func(name string, help string, kind string, value func() float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.funcs = append(m.funcs, metricFunc{metricsPrefix + name, help, kind, value})
+}
+
+// Error counts err by its class.
+func (m *Metrics) Error(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.errors == nil {
+		m.errors = make(map[ErrorClass]uint64)
+	}
+	m.errors[ClassifyError(err)]++
+}
+
+// Upload records a completed upload which took attempts tries.
+func (m *Metrics) Upload(duration time.Duration, size int64, attempts int) {
+	durations, sizes := m.histograms()
+
+	durations.Observe(duration.Seconds())
+	sizes.Observe(float64(size))
+	m.Retries(attempts)
+}
+
+// Retries counts the retries of an upload which took attempts tries.
+func (m *Metrics) Retries(attempts int) {
+	if attempts > 1 {
+		atomic.AddUint64(&m.retries, uint64(attempts-1))
+	}
+}
+
+// InFlight adds n to the bytes of running transfers, n is negative when
+// one is over.
+func (m *Metrics) InFlight(n int64) {
+	atomic.AddInt64(&m.inFlight, n)
+}
+
+func (m *Metrics) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	w := bufio.NewWriter(rw)
+	defer w.Flush()
+
+	durations, sizes := m.histograms()
+
+	m.mu.Lock()
+	funcs := append([]metricFunc{}, m.funcs...)
+	classes := make([]string, 0, len(m.errors))
+	errors := make(map[string]uint64)
+	for class, n := range m.errors {
+		classes = append(classes, string(class))
+		errors[string(class)] = n
+	}
+	m.mu.Unlock()
+
+	for _, f := range funcs {
+		writeHeader(w, f.name, f.help, f.kind)
+		fmt.Fprintf(w, "%s %s\n", f.name, formatFloat(f.value()))
+	}
+
+	sort.Strings(classes)
+	writeHeader(w, metricsPrefix+"errors_total", "Failed uploads by error class.", "counter")
+	for _, class := range classes {
+		fmt.Fprintf(w, "%serrors_total{class=%q} %d\n", metricsPrefix, class, errors[class])
+	}
+
+	writeHeader(w, metricsPrefix+"retries_total", "Retried upload attempts.", "counter")
+	fmt.Fprintf(w, "%sretries_total %d\n", metricsPrefix, atomic.LoadUint64(&m.retries))
+
+	writeHeader(w, metricsPrefix+"in_flight_bytes", "Size of running transfers.", "gauge")
+	fmt.Fprintf(w, "%sin_flight_bytes %d\n", metricsPrefix, atomic.LoadInt64(&m.inFlight))
+
+	durations.write(w, metricsPrefix+"upload_duration_seconds", "Time of completed uploads including retries.")
+	sizes.write(w, metricsPrefix+"upload_size_bytes", "Size of completed uploads.")
+}
+
+// Listen serves the metrics on addr at /metrics.
+func (m *Metrics) Listen(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+
+	return http.ListenAndServe(addr, mux)
+}
+
+func writeHeader(w *bufio.Writer, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
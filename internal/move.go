@@ -0,0 +1,225 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/mitchellh/goamz/s3"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const MaxDeleteBatch = 1000 //s3 deletes at most 1000 keys per request
+
+var SameObjectError = errors.New("source and destination are the same object")
+
+// DeleteError is a source which could not be deleted.
+type DeleteError struct {
+	SourceLine string
+	KeySource  string //as given to RemoveObject, for the error log
+	Err        error
+}
+
+type pendingDelete struct {
+	sourceLine string
+	keySource  string
+	key        string
+	deleted    func() //called once the object is deleted
+}
+
+// Remover deletes sources of moved files and records every deletion in
+// an audit file as "time ### source line ### deleted <file or bucket/key>".
+// Local files are removed at once, source objects are collected and
+// deleted in batches with a multi-object delete.
+type Remover struct {
+	mu      sync.Mutex
+	auditMu sync.Mutex
+	audit   *os.File
+	bucket  *s3.Bucket
+	batch   int
+	retry   RetryPolicy
+	pending []pendingDelete
+}
+
+func NewRemover(auditName string, bucket *s3.Bucket, batch int, retry RetryPolicy) (r *Remover, err error) {
+	if batch < 1 || batch > MaxDeleteBatch {
+		batch = MaxDeleteBatch
+	}
+
+	audit, err := os.OpenFile(auditName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return
+	}
+
+	r = &Remover{audit: audit, bucket: bucket, batch: batch, retry: retry}
+
+	return
+}
+
+// RemoveFile deletes the local file name. A file which is gone already, as
+// after a crash before its deletion was journaled, counts as deleted.
+func (r *Remover) RemoveFile(sourceLine string, name string) (err error) {
+	err = os.Remove(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return
+	}
+
+	return r.record(sourceLine, name)
+}
+
+// RemoveObject queues the source object of sourceLine, whose key was mapped
+// from keySource, for deletion, deleted is called once it's deleted. The
+// queue is sent when it's full; failures of that batch are returned.
+func (r *Remover) RemoveObject(sourceLine string, keySource string, key string, deleted func()) (failed []DeleteError) {
+	r.mu.Lock()
+	r.pending = append(r.pending, pendingDelete{sourceLine, keySource, strings.TrimPrefix(key, "/"), deleted})
+
+	if len(r.pending) < r.batch {
+		r.mu.Unlock()
+		return
+	}
+
+	batch := r.pending
+	r.pending = nil
+	r.mu.Unlock()
+
+	return r.deleteBatch(batch)
+}
+
+// Flush deletes the queued objects and returns the failed ones.
+func (r *Remover) Flush() (failed []DeleteError) {
+	r.mu.Lock()
+	batch := r.pending
+	r.pending = nil
+	r.mu.Unlock()
+
+	if len(batch) == 0 {
+		return
+	}
+
+	return r.deleteBatch(batch)
+}
+
+// Close closes the audit file. Queued objects are not deleted, call Flush
+// first.
+func (r *Remover) Close() error {
+	r.auditMu.Lock()
+	defer r.auditMu.Unlock()
+
+	if err := r.audit.Sync(); err != nil {
+		r.audit.Close()
+		return err
+	}
+
+	return r.audit.Close()
+}
+
+func (r *Remover) deleteBatch(batch []pendingDelete) (failed []DeleteError) {
+	var keyErrors map[string]error
+
+	keys := make([]string, len(batch))
+	for i, p := range batch {
+		keys[i] = p.key
+	}
+
+	_, err := r.retry.Do(func() (err error) {
+		keyErrors, err = multiDelete(r.bucket, keys)
+		return
+	})
+
+	for _, p := range batch {
+		keyErr := err
+		if keyErr == nil {
+			keyErr = keyErrors[p.key]
+		}
+
+		if keyErr == nil {
+			keyErr = r.record(p.sourceLine, r.bucket.Name+"/"+p.key)
+		}
+
+		if keyErr != nil {
+			failed = append(failed, DeleteError{p.sourceLine, p.keySource, fmt.Errorf("delete source: %w", keyErr)})
+		} else if p.deleted != nil {
+			p.deleted()
+		}
+	}
+
+	return
+}
+
+func (r *Remover) record(sourceLine string, deleted string) (err error) {
+	r.auditMu.Lock()
+	defer r.auditMu.Unlock()
+
+	_, err = fmt.Fprintf(r.audit, "%s ### %s ### deleted %s\n", time.Now(), sourceLine, deleted)
+
+	return
+}
+
+// multiDelete deletes keys with a single request and returns the errors of
+// the keys which were not deleted. Unlike Bucket.MultiDel it reports them.
+func multiDelete(bucket *s3.Bucket, keys []string) (keyErrors map[string]error, err error) {
+	var request struct {
+		XMLName xml.Name `xml:"Delete"`
+		Quiet   bool
+		Object  []struct{ Key string }
+	}
+	var result struct {
+		Error []struct {
+			Key     string
+			Code    string
+			Message string
+		}
+	}
+
+	//only errors are returned in quiet mode
+	request.Quiet = true
+	for _, key := range keys {
+		request.Object = append(request.Object, struct{ Key string }{key})
+	}
+
+	body, err := xml.Marshal(request)
+	if err != nil {
+		return
+	}
+
+	sum := md5.Sum(body)
+	headers := http.Header{"Content-MD5": {base64.StdEncoding.EncodeToString(sum[:])}}
+
+	//deletes of verified copies are sent even when the run stops
+	resp, err := doRequest(context.Background(), bucket, "POST", "/", url.Values{"delete": {""}}, headers, bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if err = xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return
+	}
+
+	keyErrors = make(map[string]error)
+	for _, e := range result.Error {
+		statusCode := http.StatusBadRequest
+		switch e.Code {
+		case "AccessDenied":
+			statusCode = http.StatusForbidden
+		case "InternalError":
+			statusCode = http.StatusInternalServerError
+		case "SlowDown":
+			statusCode = http.StatusServiceUnavailable
+		}
+		keyErrors[e.Key] = &s3.Error{StatusCode: statusCode, Code: e.Code, Message: e.Message}
+	}
+
+	return
+}
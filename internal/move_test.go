@@ -0,0 +1,184 @@
+package internal
+
+import (
+	"errors"
+	"github.com/mitchellh/goamz/s3"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestRemoverObjects(t *testing.T) {
+	f := newFakeS3()
+	defer f.Close()
+
+	dir, err := ioutil.TempDir("", "remover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		f.objects["/src/"+key] = []byte(key)
+	}
+	f.deleteErrors["b"] = "AccessDenied"
+
+	r, err := NewRemover(filepath.Join(dir, "audit.log"), f.bucket("src"), 2, RetryPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var deleted []string
+	remove := func(line string, key string) []DeleteError {
+		return r.RemoveObject(line, "key source of "+line, key, func() {
+			deleted = append(deleted, line)
+		})
+	}
+
+	//queued until the batch is full
+	if failed := remove("line a", "/a"); len(failed) != 0 || len(f.deletes) != 0 {
+		t.Fatalf("failed %v, deletes %v before the batch is full", failed, f.deletes)
+	}
+
+	failed := remove("line b", "b")
+	if len(failed) != 1 || failed[0].SourceLine != "line b" || failed[0].KeySource != "key source of line b" {
+		t.Fatalf("failed %+v, expected line b", failed)
+	}
+
+	var s3Err *s3.Error
+	if !errors.As(failed[0].Err, &s3Err) || s3Err.Code != "AccessDenied" || ClassifyError(failed[0].Err) != ErrorClassAccess {
+		t.Errorf("error %v of line b", failed[0].Err)
+	}
+
+	if failed = remove("line c", "c"); len(failed) != 0 {
+		t.Errorf("failed %+v of line c", failed)
+	}
+
+	if failed = r.Flush(); len(failed) != 0 {
+		t.Errorf("failed %+v on flush", failed)
+	}
+
+	if failed = r.Flush(); len(failed) != 0 || len(f.deletes) != 2 {
+		t.Errorf("failed %+v, deletes %v of an empty flush", failed, f.deletes)
+	}
+
+	if err = r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := [][]string{{"a", "b"}, {"c"}}; !reflect.DeepEqual(f.deletes, expected) {
+		t.Errorf("deletes %v, expected %v", f.deletes, expected)
+	}
+
+	if expected := []string{"line a", "line c"}; !reflect.DeepEqual(deleted, expected) {
+		t.Errorf("deleted %v, expected %v", deleted, expected)
+	}
+
+	for key, expected := range map[string]bool{"a": false, "b": true, "c": false, "d": true} {
+		if _, found := f.objects["/src/"+key]; found != expected {
+			t.Errorf("object %s found %v, expected %v", key, found, expected)
+		}
+	}
+
+	audit, err := ioutil.ReadFile(filepath.Join(dir, "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(audit), "\n"), "\n")
+	expected := []*regexp.Regexp{
+		regexp.MustCompile(`^\d{4}-\d\d-\d\d .+ ### line a ### deleted src/a$`),
+		regexp.MustCompile(`^\d{4}-\d\d-\d\d .+ ### line c ### deleted src/c$`),
+	}
+
+	if len(lines) != len(expected) {
+		t.Fatalf("audit lines %q", lines)
+	}
+
+	for i, re := range expected {
+		if !re.MatchString(lines[i]) {
+			t.Errorf("audit line %q doesn't match %s", lines[i], re)
+		}
+	}
+}
+
+func TestRemoverBatchFailure(t *testing.T) {
+	f := newFakeS3()
+	f.Close() //every request fails
+
+	dir, err := ioutil.TempDir("", "remover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := NewRemover(filepath.Join(dir, "audit.log"), f.bucket("src"), 0, RetryPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	deleted := false
+	for _, key := range []string{"a", "b"} {
+		r.RemoveObject(key, key, key, func() { deleted = true })
+	}
+
+	failed := r.Flush()
+	if len(failed) != 2 || failed[0].SourceLine != "a" || failed[1].SourceLine != "b" || deleted {
+		t.Errorf("failed %+v, deleted %v", failed, deleted)
+	}
+
+	for _, e := range failed {
+		if ClassifyError(e.Err) != ErrorClassNetwork {
+			t.Errorf("error %v of %s", e.Err, e.SourceLine)
+		}
+	}
+}
+
+func TestRemoverFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "a.txt")
+	if err = ioutil.WriteFile(name, []byte("a"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewRemover(filepath.Join(dir, "audit.log"), nil, 0, RetryPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = r.RemoveFile("line a", name); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("%s not removed: %v", name, err)
+	}
+
+	//gone already, as after a crash before the journal was written
+	if err = r.RemoveFile("line a", name); err != nil {
+		t.Errorf("removing a missing file: %v", err)
+	}
+
+	if err = r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	audit, err := ioutil.ReadFile(filepath.Join(dir, "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lines := strings.Split(strings.TrimSuffix(string(audit), "\n"), "\n"); len(lines) != 1 || !strings.HasSuffix(lines[0], " ### line a ### deleted "+name) {
+		t.Errorf("audit lines %q", lines)
+	}
+}
@@ -0,0 +1,186 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/mitchellh/goamz/s3"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+)
+
+const (
+	MinPartSize = 5 * 1024 * 1024 //s3 rejects smaller parts except the last one
+	maxParts    = 10000
+)
+
+var PartSizeTooSmallError = errors.New("part size is too small")
+var MultipartSizeMismatchError = errors.New("multipart upload size mismatch")
+
+// initMulti starts a multipart upload like Bucket.InitMulti does, but with
+// arbitrary headers, so metadata can be set on the object.
+func initMulti(ctx context.Context, bucket *s3.Bucket, key string, headers http.Header) (multi *s3.Multi, err error) {
+	var result struct {
+		UploadId string `xml:"UploadId"`
+	}
+
+	resp, err := doRequest(ctx, bucket, "POST", key, url.Values{"uploads": {""}}, headers, nil, 0)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if err = xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return
+	}
+
+	multi = &s3.Multi{Bucket: bucket, Key: key, UploadId: result.UploadId}
+
+	return
+}
+
+// putPart uploads part n of multi like Multi.PutPart does, but canceled
+// once ctx is done.
+func putPart(ctx context.Context, multi *s3.Multi, n int, data []byte) (part s3.Part, err error) {
+	sum := md5.Sum(data)
+	headers := http.Header{"Content-MD5": {base64.StdEncoding.EncodeToString(sum[:])}}
+	params := url.Values{"uploadId": {multi.UploadId}, "partNumber": {strconv.Itoa(n)}}
+
+	resp, err := doRequest(ctx, multi.Bucket, "PUT", multi.Key, params, headers, bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+
+	part = s3.Part{N: n, ETag: resp.Header.Get("ETag"), Size: int64(len(data))}
+
+	return
+}
+
+// fitPartSize doubles partSize until size fits the 10000 parts s3 allows
+// per upload.
+func fitPartSize(size int64, partSize int64) int64 {
+	for size/partSize >= maxParts {
+		partSize *= 2
+	}
+	return partSize
+}
+
+// PutMultipart uploads size bytes from r to key using a multipart upload.
+// Parts are read sequentially and sent by up to concurrency goroutines, so at
+// most concurrency*partSize bytes are held in memory. The upload is aborted
+// if any part or the final complete request fails. The returned etag is the
+// one s3 is expected to assign to the object, see MultipartEtag. Parts are
+// not sent once ctx is done.
+func PutMultipart(ctx context.Context, bucket *s3.Bucket, key string, r io.Reader, size int64, headers http.Header, partSize int64, concurrency int) (etag string, err error) {
+	var (
+		multi    *s3.Multi
+		parts    []s3.Part
+		partSums [][]byte
+		total    int64
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+	)
+
+	if partSize < MinPartSize {
+		err = fmt.Errorf("%w: %d", PartSizeTooSmallError, partSize)
+		return
+	}
+
+	partSize = fitPartSize(size, partSize)
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	multi, err = initMulti(ctx, bucket, key, headers)
+	if err != nil {
+		return
+	}
+
+	pool := make(chan bool, concurrency)
+
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return err != nil
+	}
+
+	fail := func(e error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err == nil {
+			err = e
+		}
+	}
+
+	for n := 1; !failed(); n++ {
+		pool <- true
+
+		buf := make([]byte, partSize)
+		read, readErr := io.ReadFull(r, buf)
+
+		if readErr == io.EOF {
+			<-pool
+			break
+		} else if readErr != nil && readErr != io.ErrUnexpectedEOF {
+			<-pool
+			fail(readErr)
+			break
+		}
+
+		total += int64(read)
+
+		sum := md5.Sum(buf[:read])
+		partSums = append(partSums, sum[:])
+
+		wg.Add(1)
+		go func(n int, data []byte) {
+			defer func() {
+				<-pool
+				wg.Done()
+			}()
+
+			part, putErr := putPart(ctx, multi, n, data)
+			if putErr != nil {
+				fail(fmt.Errorf("part %d: %w", n, putErr))
+				return
+			}
+
+			mu.Lock()
+			parts = append(parts, part)
+			mu.Unlock()
+		}(n, buf[:read])
+
+		if readErr == io.ErrUnexpectedEOF {
+			break
+		}
+	}
+
+	wg.Wait()
+
+	if err == nil && total != size {
+		err = fmt.Errorf("%w: expected %d, read %d", MultipartSizeMismatchError, size, total)
+	}
+
+	if err == nil {
+		err = multi.Complete(parts)
+	}
+
+	if err == nil {
+		etag = MultipartEtag(partSums)
+	}
+
+	if err != nil {
+		multi.Abort()
+	}
+
+	return
+}
@@ -0,0 +1,253 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"github.com/mitchellh/goamz/s3"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 is an in-memory s3 serving the requests of PutObject, HeadObject,
+// multipart uploads and multi-object deletes. It must be closed.
+type fakeS3 struct {
+	mu           sync.Mutex
+	objects      map[string][]byte
+	parts        map[int][]byte //parts of the running multipart upload
+	aborted      bool
+	deletes      [][]string        //keys of every multi-object delete
+	deleteErrors map[string]string //error codes of keys which are not deleted
+	server       *httptest.Server
+}
+
+func newFakeS3() *fakeS3 {
+	f := &fakeS3{objects: make(map[string][]byte), parts: make(map[int][]byte), deleteErrors: make(map[string]string)}
+	f.server = httptest.NewServer(http.HandlerFunc(f.handle))
+	return f
+}
+
+func (f *fakeS3) Close() {
+	f.server.Close()
+}
+
+// bucket returns a bucket of the fake s3.
+func (f *fakeS3) bucket(name string) *s3.Bucket {
+	client := GetS3Client(S3ClientConfig{
+		UseHttp:          true,
+		AccessKey:        "a",
+		SecretKey:        "b",
+		Endpoint:         strings.TrimPrefix(f.server.URL, "http://"),
+		SignatureVersion: SignatureV2,
+	})
+	return client.Bucket(name)
+}
+
+func (f *fakeS3) handle(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	query := r.URL.Query()
+	body, _ := ioutil.ReadAll(r.Body)
+
+	switch {
+	case r.Method == "POST" && hasParam(r, "uploads"):
+		f.parts = make(map[int][]byte)
+		w.Write([]byte("<InitiateMultipartUploadResult><UploadId>1</UploadId></InitiateMultipartUploadResult>"))
+	case r.Method == "PUT" && query.Get("partNumber") != "":
+		n, _ := strconv.Atoi(query.Get("partNumber"))
+		f.parts[n] = body
+		sum := md5.Sum(body)
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+	case r.Method == "POST" && hasParam(r, "delete"):
+		var request struct {
+			Object []struct{ Key string }
+		}
+		xml.Unmarshal(body, &request)
+
+		var keys []string
+		result := "<DeleteResult>"
+		for _, object := range request.Object {
+			keys = append(keys, object.Key)
+			if code, found := f.deleteErrors[object.Key]; found {
+				result += "<Error><Key>" + object.Key + "</Key><Code>" + code + "</Code><Message>failed</Message></Error>"
+			} else {
+				delete(f.objects, r.URL.Path+object.Key)
+			}
+		}
+		f.deletes = append(f.deletes, keys)
+		w.Write([]byte(result + "</DeleteResult>"))
+	case r.Method == "POST" && query.Get("uploadId") != "":
+		var numbers []int
+		for n := range f.parts {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+		var content []byte
+		for _, n := range numbers {
+			content = append(content, f.parts[n]...)
+		}
+		f.objects[r.URL.Path] = content
+		w.Write([]byte("<CompleteMultipartUploadResult></CompleteMultipartUploadResult>"))
+	case r.Method == "DELETE" && query.Get("uploadId") != "":
+		f.aborted = true
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "PUT":
+		f.objects[r.URL.Path] = body
+		sum := md5.Sum(body)
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+	case r.Method == "HEAD" || r.Method == "GET":
+		content, found := f.objects[r.URL.Path]
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		if r.Method == "GET" {
+			w.Write(content)
+		}
+	}
+}
+
+func hasParam(r *http.Request, name string) bool {
+	_, found := r.URL.Query()[name]
+	return found
+}
+
+func TestFitPartSize(t *testing.T) {
+	tests := []struct {
+		size, partSize, expected int64
+	}{
+		{0, MinPartSize, MinPartSize},
+		{MinPartSize * (maxParts - 1), MinPartSize, MinPartSize},
+		{MinPartSize * maxParts, MinPartSize, MinPartSize * 2},
+		{MinPartSize * maxParts * 3, MinPartSize, MinPartSize * 4},
+	}
+
+	for _, test := range tests {
+		if actual := fitPartSize(test.size, test.partSize); actual != test.expected {
+			t.Errorf("fitPartSize(%d, %d) = %d, expected %d", test.size, test.partSize, actual, test.expected)
+		}
+	}
+}
+
+func TestMultipartEtag(t *testing.T) {
+	first := md5.Sum([]byte("first"))
+	second := md5.Sum([]byte("second"))
+
+	expected := md5.Sum(append(first[:], second[:]...))
+
+	if actual := MultipartEtag([][]byte{first[:], second[:]}); actual != hex.EncodeToString(expected[:])+"-2" {
+		t.Errorf("MultipartEtag = %s", actual)
+	}
+}
+
+func TestPutMultipart(t *testing.T) {
+	tests := []struct {
+		name  string
+		size  int64
+		parts int
+	}{
+		{"one short part", 1024, 1},
+		{"exact parts", 2 * MinPartSize, 2},
+		{"short last part", 2*MinPartSize + 1, 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeS3()
+			defer fake.Close()
+
+			content := bytes.Repeat([]byte("0123456789"), int(test.size/10+1))[:test.size]
+
+			etag, err := PutMultipart(context.Background(), fake.bucket("b"), "dir/key", bytes.NewReader(content), test.size, nil, MinPartSize, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(fake.parts) != test.parts {
+				t.Errorf("%d parts uploaded, expected %d", len(fake.parts), test.parts)
+			}
+
+			var sums [][]byte
+			for n := 1; n <= test.parts; n++ {
+				sum := md5.Sum(fake.parts[n])
+				sums = append(sums, sum[:])
+			}
+			if expected := MultipartEtag(sums); etag != expected {
+				t.Errorf("etag %s, expected %s", etag, expected)
+			}
+
+			if !bytes.Equal(fake.objects["/b/dir/key"], content) {
+				t.Error("stored object differs from the content")
+			}
+		})
+	}
+}
+
+func TestPutMultipartSizeMismatch(t *testing.T) {
+	fake := newFakeS3()
+	defer fake.Close()
+
+	_, err := PutMultipart(context.Background(), fake.bucket("b"), "key", bytes.NewReader(make([]byte, 100)), 200, nil, MinPartSize, 1)
+	if !errors.Is(err, MultipartSizeMismatchError) {
+		t.Errorf("error %v, expected %v", err, MultipartSizeMismatchError)
+	}
+
+	if !fake.aborted {
+		t.Error("upload not aborted")
+	}
+}
+
+// cancelReader cancels the upload once more than after bytes are read.
+type cancelReader struct {
+	r      io.Reader
+	read   int
+	after  int
+	cancel func()
+}
+
+func (r *cancelReader) Read(p []byte) (n int, err error) {
+	n, err = r.r.Read(p)
+	if r.read += n; r.read > r.after {
+		r.cancel()
+	}
+	return
+}
+
+func TestPutMultipartCanceled(t *testing.T) {
+	fake := newFakeS3()
+	defer fake.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	size := 2 * MinPartSize
+	r := &cancelReader{r: bytes.NewReader(make([]byte, size)), after: MinPartSize, cancel: cancel}
+
+	_, err := PutMultipart(ctx, fake.bucket("b"), "key", r, int64(size), nil, MinPartSize, 1)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("error %v, expected %v", err, context.Canceled)
+	}
+
+	if len(fake.parts) != 1 || !fake.aborted {
+		t.Errorf("%d parts sent, aborted %v", len(fake.parts), fake.aborted)
+	}
+}
+
+func TestPutMultipartPartSizeTooSmall(t *testing.T) {
+	_, err := PutMultipart(context.Background(), nil, "key", bytes.NewReader(nil), 0, nil, MinPartSize-1, 1)
+	if !errors.Is(err, PartSizeTooSmallError) {
+		t.Errorf("error %v, expected %v", err, PartSizeTooSmallError)
+	}
+}
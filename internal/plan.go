@@ -0,0 +1,147 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const (
+	PlanFormatCsv  = "csv"
+	PlanFormatJson = "json"
+
+	PlanActionUpload    = "upload"
+	PlanActionMultipart = "multipart"
+	PlanActionCopy      = "copy" //copied on the server
+	PlanActionSkip      = "skip" //unchanged in sync mode
+	PlanActionError     = "error"
+)
+
+// PlanEntry is what a run would do with a single source.
+type PlanEntry struct {
+	Source      string `json:"source"`
+	Key         string `json:"key"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type"`
+	TypeSource  string `json:"content_type_source"`
+	Acl         string `json:"acl"`
+	Action      string `json:"action"`
+	Error       string `json:"error,omitempty"`
+}
+
+type PlanTotal struct {
+	Count int64 `json:"count"`
+	Size  int64 `json:"size"`
+}
+
+// Plan writes entries of a dry run as CSV or JSON lines and sums them up
+// by action. JSON plans end with a {"totals": ...} line on Close, CSV plans
+// hold entries only, see Totals.
+type Plan struct {
+	mu     sync.Mutex
+	format string
+	out    io.WriteCloser
+	buf    *bufio.Writer
+	csv    *csv.Writer
+	json   *json.Encoder
+	totals map[string]*PlanTotal
+}
+
+func NewPlan(out io.WriteCloser, format string) (p *Plan, err error) {
+	p = &Plan{format: format, out: out, buf: bufio.NewWriter(out), totals: make(map[string]*PlanTotal)}
+
+	switch format {
+	case PlanFormatCsv:
+		p.csv = csv.NewWriter(p.buf)
+		err = p.csv.Write([]string{"source", "key", "size", "content_type", "content_type_source", "acl", "action", "error"})
+	case PlanFormatJson:
+		p.json = json.NewEncoder(p.buf)
+	default:
+		err = fmt.Errorf("unknown plan format %q", format)
+	}
+
+	if err != nil {
+		p = nil
+	}
+
+	return
+}
+
+func (p *Plan) Add(entry PlanEntry) (err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	total := p.totals[entry.Action]
+	if total == nil {
+		total = &PlanTotal{}
+		p.totals[entry.Action] = total
+	}
+	total.Count++
+	total.Size += entry.Size
+
+	if p.csv != nil {
+		err = p.csv.Write([]string{
+			entry.Source,
+			entry.Key,
+			strconv.FormatInt(entry.Size, 10),
+			entry.ContentType,
+			entry.TypeSource,
+			entry.Acl,
+			entry.Action,
+			entry.Error,
+		})
+		return
+	}
+
+	return p.json.Encode(entry)
+}
+
+// Totals returns a one line summary of the plan.
+func (p *Plan) Totals() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var all PlanTotal
+	actions := make([]string, 0, len(p.totals))
+	for action, total := range p.totals {
+		actions = append(actions, action)
+		all.Count += total.Count
+		all.Size += total.Size
+	}
+	sort.Strings(actions)
+
+	summary := fmt.Sprintf("total: %d objects, %d bytes", all.Count, all.Size)
+	for _, action := range actions {
+		summary += fmt.Sprintf("; %s: %d objects, %d bytes", action, p.totals[action].Count, p.totals[action].Size)
+	}
+
+	return summary
+}
+
+// Close writes the totals of a JSON plan and closes the output.
+func (p *Plan) Close() (err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.csv != nil {
+		p.csv.Flush()
+		err = p.csv.Error()
+	} else {
+		err = p.json.Encode(map[string]map[string]*PlanTotal{"totals": p.totals})
+	}
+
+	if flushErr := p.buf.Flush(); err == nil {
+		err = flushErr
+	}
+
+	if closeErr := p.out.Close(); err == nil {
+		err = closeErr
+	}
+
+	return
+}
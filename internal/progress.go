@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type progressSample struct {
+	time  time.Time
+	files uint64
+	bytes uint64
+}
+
+// Progress keeps samples of processed files and bytes to estimate the
+// current rate, the average rate over a window and the remaining time.
+type Progress struct {
+	mu      sync.Mutex
+	window  time.Duration
+	samples []progressSample
+}
+
+func NewProgress(window time.Duration) *Progress {
+	return &Progress{window: window}
+}
+
+// Add records the totals at t. Samples older than the window are dropped.
+func (p *Progress) Add(t time.Time, files uint64, bytes uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.samples = append(p.samples, progressSample{t, files, bytes})
+
+	//one sample older than the window is kept as its start
+	for len(p.samples) > 2 && t.Sub(p.samples[1].time) >= p.window {
+		p.samples = p.samples[1:]
+	}
+}
+
+// Rates returns bytes per second since the previous sample and the
+// average bytes and files per second over the window.
+func (p *Progress) Rates() (current float64, average float64, averageFiles float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	n := len(p.samples)
+	if n < 2 {
+		return
+	}
+
+	last, previous, first := p.samples[n-1], p.samples[n-2], p.samples[0]
+
+	if elapsed := last.time.Sub(previous.time).Seconds(); elapsed > 0 {
+		current = float64(last.bytes-previous.bytes) / elapsed
+	}
+
+	if elapsed := last.time.Sub(first.time).Seconds(); elapsed > 0 {
+		average = float64(last.bytes-first.bytes) / elapsed
+		averageFiles = float64(last.files-first.files) / elapsed
+	}
+
+	return
+}
+
+// Eta returns the time to process remaining units at rate units per
+// second. ok is false if nothing is processed at the moment.
+func Eta(remaining uint64, rate float64) (eta time.Duration, ok bool) {
+	if rate <= 0 {
+		return
+	}
+
+	eta = time.Duration(float64(remaining) / rate * float64(time.Second)).Round(time.Second)
+	ok = true
+
+	return
+}
+
+// FormatBytes returns n in B, KB, MB or GB.
+func FormatBytes(n float64) string {
+	switch {
+	case n > 1073741824:
+		return fmt.Sprintf("%.2f GB", n/1073741824)
+	case n > 1048576:
+		return fmt.Sprintf("%.2f MB", n/1048576)
+	case n > 1024:
+		return fmt.Sprintf("%.2f KB", n/1024)
+	}
+	return fmt.Sprintf("%.0f B", n)
+}
@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"context"
+	"encoding/xml"
+	"github.com/mitchellh/goamz/s3"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// doRequest sends a request for key of bucket the same way goamz does, for
+// the requests goamz can't make or whose response headers it doesn't return.
+// Responses other than 200 and 204 are returned as *s3.Error. The request is
+// canceled once ctx is done.
+func doRequest(ctx context.Context, bucket *s3.Bucket, method string, key string, params url.Values, headers http.Header, body io.Reader, length int64) (resp *http.Response, err error) {
+	u, err := url.Parse(bucket.S3.Region.S3Endpoint)
+	if err != nil {
+		return
+	}
+
+	if !strings.HasPrefix(key, "/") {
+		key = "/" + key
+	}
+
+	if headers == nil {
+		headers = make(http.Header)
+	}
+
+	if params == nil {
+		params = make(url.Values)
+	}
+
+	path := "/" + bucket.Name + key
+
+	u.Opaque = amazonEscape(path)
+	u.RawQuery = params.Encode()
+
+	headers["Host"] = []string{u.Host}
+	headers["Date"] = []string{time.Now().In(time.UTC).Format(time.RFC1123)}
+
+	sign(bucket.S3.Auth, method, path, params, headers)
+
+	hreq := &http.Request{
+		URL:           u,
+		Method:        method,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        headers,
+		ContentLength: length,
+	}
+	hreq = hreq.WithContext(ctx)
+
+	//a body of zero length would be sent chunked
+	if body != nil && length > 0 {
+		hreq.Body = ioutil.NopCloser(body)
+	}
+
+	resp, err = bucket.HTTPClient().Do(hreq)
+	if err != nil {
+		return
+	}
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		err = buildError(resp)
+		resp = nil
+	}
+
+	return
+}
+
+// buildError reads the s3 error response the way goamz does.
+func buildError(resp *http.Response) error {
+	s3Err := &s3.Error{}
+
+	xml.NewDecoder(resp.Body).Decode(s3Err)
+	resp.Body.Close()
+
+	s3Err.StatusCode = resp.StatusCode
+	if s3Err.Message == "" {
+		s3Err.Message = resp.Status
+	}
+
+	return s3Err
+}
+
+// PutObject uploads length bytes of r to key with headers and returns the
+// ETag of the stored object.
+func PutObject(ctx context.Context, bucket *s3.Bucket, key string, r io.Reader, length int64, headers http.Header) (etag string, err error) {
+	resp, err := doRequest(ctx, bucket, "PUT", key, nil, headers, r, length)
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+
+	etag = resp.Header.Get("ETag")
+
+	return
+}
+
+// HeadObject returns the response headers of key.
+func HeadObject(ctx context.Context, bucket *s3.Bucket, key string) (header http.Header, err error) {
+	resp, err := doRequest(ctx, bucket, "HEAD", key, nil, nil, nil, 0)
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+
+	header = resp.Header
+
+	return
+}
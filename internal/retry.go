@@ -0,0 +1,178 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"github.com/mitchellh/goamz/s3"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"time"
+)
+
+type ErrorClass string
+
+const (
+	ErrorClassNetwork  ErrorClass = "network"
+	ErrorClassServer   ErrorClass = "server"
+	ErrorClassThrottle ErrorClass = "throttle"
+	ErrorClassAccess   ErrorClass = "access"
+	ErrorClassNotFound ErrorClass = "not_found"
+	ErrorClassClient   ErrorClass = "client"
+	ErrorClassMime     ErrorClass = "mime"
+	ErrorClassAcl      ErrorClass = "acl"
+	ErrorClassInvalid  ErrorClass = "invalid"
+	ErrorClassChecksum ErrorClass = "checksum"
+	ErrorClassCanceled ErrorClass = "canceled" //by shutdown
+	ErrorClassUnknown  ErrorClass = "unknown"
+)
+
+var errorClasses = []ErrorClass{
+	ErrorClassNetwork,
+	ErrorClassServer,
+	ErrorClassThrottle,
+	ErrorClassAccess,
+	ErrorClassNotFound,
+	ErrorClassClient,
+	ErrorClassMime,
+	ErrorClassAcl,
+	ErrorClassInvalid,
+	ErrorClassChecksum,
+	ErrorClassCanceled,
+	ErrorClassUnknown,
+}
+
+// Valid reports whether c is one of the known error classes.
+func (c ErrorClass) Valid() bool {
+	for _, class := range errorClasses {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// Retryable reports whether errors of the class are worth another attempt.
+func (c ErrorClass) Retryable() bool {
+	switch c {
+	case ErrorClassNetwork, ErrorClassServer, ErrorClassThrottle, ErrorClassChecksum:
+		return true
+	}
+	return false
+}
+
+// ClassifyError sorts err into one of the error classes.
+func ClassifyError(err error) ErrorClass {
+	var s3Err *s3.Error
+	var statusErr *HttpStatusError
+	var netErr net.Error
+
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, context.Canceled):
+		return ErrorClassCanceled
+	case errors.Is(err, MimeTypeNotRecognizedError):
+		return ErrorClassMime
+	case errors.Is(err, NotImplementedAclMappingError), errors.Is(err, UnmappedGranteeError):
+		return ErrorClassAcl
+	case errors.Is(err, FileInvalidSizeError), errors.Is(err, SameObjectError), errors.Is(err, KeyMappingError),
+		errors.Is(err, DuplicateKeyError):
+		return ErrorClassInvalid
+	case errors.Is(err, ChecksumMismatchError):
+		return ErrorClassChecksum
+	case errors.Is(err, os.ErrNotExist):
+		return ErrorClassNotFound
+	case errors.Is(err, os.ErrPermission):
+		return ErrorClassAccess
+	case errors.As(err, &s3Err):
+		switch s3Err.Code {
+		case "SlowDown":
+			return ErrorClassThrottle
+		case "RequestTimeout":
+			return ErrorClassNetwork
+		case "BadDigest", "InvalidDigest":
+			return ErrorClassChecksum
+		}
+		return classifyStatus(s3Err.StatusCode)
+	case errors.As(err, &statusErr):
+		return classifyStatus(statusErr.StatusCode)
+	case errors.As(err, &netErr),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.EPIPE):
+		return ErrorClassNetwork
+	}
+
+	return ErrorClassUnknown
+}
+
+func classifyStatus(statusCode int) ErrorClass {
+	switch {
+	case statusCode == http.StatusServiceUnavailable, statusCode == http.StatusTooManyRequests:
+		return ErrorClassThrottle
+	case statusCode >= 500:
+		return ErrorClassServer
+	case statusCode == http.StatusForbidden, statusCode == http.StatusUnauthorized:
+		return ErrorClassAccess
+	case statusCode == http.StatusNotFound:
+		return ErrorClassNotFound
+	case statusCode == http.StatusRequestTimeout:
+		return ErrorClassNetwork
+	}
+	return ErrorClassClient
+}
+
+// RetryPolicy retries retryable errors with jittered exponential backoff.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// Do calls f until it succeeds, returns a permanent error or MaxAttempts
+// is reached. It returns the number of attempts made and the last error.
+func (p RetryPolicy) Do(f func() error) (attempts int, err error) {
+	return p.DoContext(context.Background(), f)
+}
+
+// DoContext is Do which makes no more attempts once ctx is done.
+func (p RetryPolicy) DoContext(ctx context.Context, f func() error) (attempts int, err error) {
+	for {
+		attempts++
+		err = f()
+
+		if err == nil || attempts >= p.MaxAttempts || !ClassifyError(err).Retryable() || ctx.Err() != nil {
+			return
+		}
+
+		select {
+		case <-time.After(p.backoff(attempts)):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// backoff returns a random delay up to BaseDelay*2^(attempt-1), capped
+// by MaxDelay ("full jitter").
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempt && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+
+	if delay <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(delay)) + 1)
+}
@@ -0,0 +1,120 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/mitchellh/goamz/s3"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected ErrorClass
+	}{
+		{nil, ""},
+		{context.Canceled, ErrorClassCanceled},
+		{fmt.Errorf("put: %w", context.Canceled), ErrorClassCanceled},
+		{MimeTypeNotRecognizedError, ErrorClassMime},
+		{NotImplementedAclMappingError, ErrorClassAcl},
+		{UnmappedGranteeError, ErrorClassAcl},
+		{FileInvalidSizeError, ErrorClassInvalid},
+		{fmt.Errorf("%w: x", KeyMappingError), ErrorClassInvalid},
+		{fmt.Errorf("%w: x", ChecksumMismatchError), ErrorClassChecksum},
+		{&os.PathError{Op: "open", Path: "x", Err: os.ErrNotExist}, ErrorClassNotFound},
+		{&os.PathError{Op: "open", Path: "x", Err: os.ErrPermission}, ErrorClassAccess},
+		{&s3.Error{StatusCode: 503, Code: "SlowDown"}, ErrorClassThrottle},
+		{&s3.Error{StatusCode: 400, Code: "RequestTimeout"}, ErrorClassNetwork},
+		{&s3.Error{StatusCode: 400, Code: "BadDigest"}, ErrorClassChecksum},
+		{&s3.Error{StatusCode: 500, Code: "InternalError"}, ErrorClassServer},
+		{&s3.Error{StatusCode: 403, Code: "AccessDenied"}, ErrorClassAccess},
+		{&s3.Error{StatusCode: 404, Code: "NoSuchKey"}, ErrorClassNotFound},
+		{&s3.Error{StatusCode: 400, Code: "InvalidArgument"}, ErrorClassClient},
+		{&HttpStatusError{StatusCode: 429}, ErrorClassThrottle},
+		{&HttpStatusError{StatusCode: 502}, ErrorClassServer},
+		{&HttpStatusError{StatusCode: 401}, ErrorClassAccess},
+		{&net.OpError{Op: "dial", Err: errors.New("refused")}, ErrorClassNetwork},
+		{io.ErrUnexpectedEOF, ErrorClassNetwork},
+		{fmt.Errorf("write: %w", syscall.EPIPE), ErrorClassNetwork},
+		{errors.New("something else"), ErrorClassUnknown},
+	}
+
+	for _, test := range tests {
+		if actual := ClassifyError(test.err); actual != test.expected {
+			t.Errorf("ClassifyError(%v) = %q, expected %q", test.err, actual, test.expected)
+		}
+	}
+}
+
+func TestErrorClassRetryable(t *testing.T) {
+	for _, class := range errorClasses {
+		expected := class == ErrorClassNetwork || class == ErrorClassServer || class == ErrorClassThrottle || class == ErrorClassChecksum
+		if class.Retryable() != expected {
+			t.Errorf("%s retryable %v, expected %v", class, class.Retryable(), expected)
+		}
+	}
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+	tests := []struct {
+		name     string
+		errs     []error
+		attempts int
+		failed   bool
+	}{
+		{"success", []error{nil}, 1, false},
+		{"retried", []error{io.ErrUnexpectedEOF, nil}, 2, false},
+		{"permanent", []error{os.ErrPermission}, 1, true},
+		{"max attempts", []error{io.ErrUnexpectedEOF, io.ErrUnexpectedEOF, io.ErrUnexpectedEOF, nil}, 3, true},
+	}
+
+	for _, test := range tests {
+		calls := 0
+		attempts, err := policy.Do(func() error {
+			calls++
+			return test.errs[calls-1]
+		})
+
+		if attempts != test.attempts || calls != test.attempts || (err != nil) != test.failed {
+			t.Errorf("%s: %d attempts, %d calls, error %v", test.name, attempts, calls, err)
+		}
+	}
+}
+
+func TestRetryPolicyDoContextCanceled(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 5, BaseDelay: time.Hour, MaxDelay: time.Hour}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	attempts, err := policy.DoContext(ctx, func() error {
+		return io.ErrUnexpectedEOF
+	})
+
+	if attempts != 1 || err != io.ErrUnexpectedEOF {
+		t.Errorf("%d attempts, error %v", attempts, err)
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+
+	for attempt := 1; attempt < 10; attempt++ {
+		max := policy.BaseDelay << uint(attempt-1)
+		if max > policy.MaxDelay {
+			max = policy.MaxDelay
+		}
+
+		if delay := policy.backoff(attempt); delay <= 0 || delay > max {
+			t.Errorf("backoff(%d) = %s, expected up to %s", attempt, delay, max)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/mitchellh/goamz/aws"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	SignatureV2 = "v2"
+	SignatureV4 = "v4"
+
+	v4Algorithm       = "AWS4-HMAC-SHA256"
+	v4TimeFormat      = "20060102T150405Z"
+	v4DateFormat      = "20060102"
+	v4UnsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+var v4EmptyPayloadHash = hex.EncodeToString(sha256.New().Sum(nil))
+
+// v4Transport replaces the V2 signature goamz puts on every request with
+// an AWS Signature Version 4 one.
+type v4Transport struct {
+	auth    aws.Auth
+	region  string
+	service string
+	next    http.RoundTripper
+}
+
+func (t *v4Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	signed := req.Clone(req.Context())
+	signed.Header.Del("Authorization")
+
+	//request bodies are streamed, so their hash is not known beforehand
+	payloadHash := signed.Header.Get("x-amz-content-sha256")
+	if payloadHash == "" {
+		payloadHash = v4EmptyPayloadHash
+		if signed.Body != nil && signed.Body != http.NoBody && signed.ContentLength != 0 {
+			payloadHash = v4UnsignedPayload
+		}
+		signed.Header.Set("x-amz-content-sha256", payloadHash)
+	}
+
+	signV4(signed, t.auth, t.region, t.service, payloadHash, time.Now())
+
+	return t.next.RoundTrip(signed)
+}
+
+// signV4 signs req in place with the hex encoded sha256 of its payload and
+// returns the canonical request and the string to sign.
+func signV4(req *http.Request, auth aws.Auth, region string, service string, payloadHash string, now time.Time) (canonicalRequest string, stringToSign string) {
+	now = now.UTC()
+	amzDate := now.Format(v4TimeFormat)
+	scope := now.Format(v4DateFormat) + "/" + region + "/" + service + "/aws4_request"
+
+	if auth.Token != "" {
+		req.Header.Set("x-amz-security-token", auth.Token)
+	}
+
+	req.Header.Set("x-amz-date", amzDate)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	signedHeaders, canonicalHeaders := v4CanonicalHeaders(req.Header, host)
+
+	canonicalRequest = strings.Join([]string{
+		req.Method,
+		v4CanonicalPath(req.URL),
+		v4CanonicalQuery(req.URL),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	stringToSign = strings.Join([]string{
+		v4Algorithm,
+		amzDate,
+		scope,
+		hashHex(canonicalRequest),
+	}, "\n")
+
+	key := hmacSha256([]byte("AWS4"+auth.SecretKey), now.Format(v4DateFormat))
+	key = hmacSha256(key, region)
+	key = hmacSha256(key, service)
+	key = hmacSha256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign))
+
+	req.Header.Set("Authorization", v4Algorithm+
+		" Credential="+auth.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+
+		", Signature="+signature)
+
+	if debug {
+		log.Printf("V4 canonical request: %q", canonicalRequest)
+		log.Printf("V4 string to sign: %q", stringToSign)
+	}
+
+	return
+}
+
+// v4CanonicalHeaders returns the list of signed headers and the canonical
+// headers block. Host, content headers and x-amz-* headers are signed.
+func v4CanonicalHeaders(header http.Header, host string) (signedHeaders string, canonicalHeaders string) {
+	values := map[string][]string{"host": {host}}
+
+	for k, v := range header {
+		k = strings.ToLower(k)
+		if k == "host" {
+			continue
+		}
+		if k == "content-type" || k == "content-md5" || strings.HasPrefix(k, "x-amz-") {
+			values[k] = append(values[k], v...)
+		}
+	}
+
+	names := make([]string, 0, len(values))
+	for k := range values {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, k := range names {
+		trimmed := make([]string, len(values[k]))
+		for i, v := range values[k] {
+			trimmed[i] = strings.Join(strings.Fields(v), " ")
+		}
+		b.WriteString(k + ":" + strings.Join(trimmed, ",") + "\n")
+	}
+
+	return strings.Join(names, ";"), b.String()
+}
+
+// v4CanonicalPath returns the URI-encoded path of u. goamz puts the
+// already escaped path to u.Opaque, so it is decoded before encoding again.
+func v4CanonicalPath(u *url.URL) string {
+	path := u.Opaque
+	if path == "" {
+		path = u.EscapedPath()
+	}
+
+	//full opaque form is "//host/path"
+	if strings.HasPrefix(path, "//") {
+		path = path[2:]
+		if i := strings.Index(path, "/"); i >= 0 {
+			path = path[i:]
+		} else {
+			path = "/"
+		}
+	}
+
+	if unescaped, err := url.PathUnescape(path); err == nil {
+		path = unescaped
+	}
+
+	if path == "" {
+		return "/"
+	}
+
+	return v4Escape(path, false)
+}
+
+func v4CanonicalQuery(u *url.URL) string {
+	query, _ := url.ParseQuery(u.RawQuery)
+
+	pairs := make([]string, 0, len(query))
+	for k, values := range query {
+		for _, v := range values {
+			pairs = append(pairs, v4Escape(k, true)+"="+v4Escape(v, true))
+		}
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, "&")
+}
+
+// v4Escape URI-encodes every byte except the unreserved characters.
+// Slashes are kept unless escapeSlash is set.
+func v4Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '_' || c == '-' || c == '~' || c == '.' || (c == '/' && !escapeSlash) {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte("0123456789ABCDEF"[c>>4])
+		b.WriteByte("0123456789ABCDEF"[c&15])
+	}
+
+	return b.String()
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	hash := hmac.New(sha256.New, key)
+	hash.Write([]byte(data))
+	return hash.Sum(nil)
+}
+
+func hashHex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
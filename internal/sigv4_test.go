@@ -0,0 +1,183 @@
+package internal
+
+import (
+	"github.com/mitchellh/goamz/aws"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// credentials, scope and time of the aws-sig-v4-test-suite
+var (
+	v4TestAuth   = aws.Auth{AccessKey: "AKIDEXAMPLE", SecretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	v4TestTime   = time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	v4TestScope  = "20150830/us-east-1/service/aws4_request"
+	v4TestHeader = "host:example.amazonaws.com\nx-amz-date:20150830T123600Z\n"
+)
+
+// TestSignV4Suite checks the signer against the cases of the
+// aws-sig-v4-test-suite which apply to s3. Paths are not normalized by s3,
+// so only the normalize-path cases without dot segments and duplicate
+// slashes are used.
+func TestSignV4Suite(t *testing.T) {
+	tests := []struct {
+		name             string
+		method           string
+		path, query      string
+		header           http.Header
+		payloadHash      string
+		canonicalRequest string
+		signature        string
+	}{
+		{
+			name:   "get-vanilla",
+			method: "GET", path: "/",
+			canonicalRequest: "GET\n/\n\n" + v4TestHeader + "\nhost;x-amz-date\n" + v4EmptyPayloadHash,
+			signature:        "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		{
+			name:   "get-vanilla-empty-query-key",
+			method: "GET", path: "/", query: "Param1=value1",
+			canonicalRequest: "GET\n/\nParam1=value1\n" + v4TestHeader + "\nhost;x-amz-date\n" + v4EmptyPayloadHash,
+			signature:        "a67d582fa61cc504c4bae71f336f98b97f1ea3c7a6bfe1b6e45aec72011b9aeb",
+		},
+		{
+			name:   "get-vanilla-query-order-key-case",
+			method: "GET", path: "/", query: "Param2=value2&Param1=value1",
+			canonicalRequest: "GET\n/\nParam1=value1&Param2=value2\n" + v4TestHeader + "\nhost;x-amz-date\n" + v4EmptyPayloadHash,
+			signature:        "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500",
+		},
+		{
+			name:   "get-vanilla-query-order-value",
+			method: "GET", path: "/", query: "Param1=value2&Param1=value1",
+			canonicalRequest: "GET\n/\nParam1=value1&Param1=value2\n" + v4TestHeader + "\nhost;x-amz-date\n" + v4EmptyPayloadHash,
+			signature:        "5772eed61e12b33fae39ee5e7012498b51d56abc0abb7c60486157bd471c4694",
+		},
+		{
+			name:   "get-vanilla-query-unreserved",
+			method: "GET", path: "/",
+			query:            "-._~0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz=-._~0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz",
+			canonicalRequest: "GET\n/\n-._~0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz=-._~0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz\n" + v4TestHeader + "\nhost;x-amz-date\n" + v4EmptyPayloadHash,
+			signature:        "9c3e54bfcdf0b19771a7f523ee5669cdf59bc7cc0884027167c21bb143a40197",
+		},
+		{
+			name:   "get-vanilla-utf8-query",
+			method: "GET", path: "/", query: "ሴ=bar",
+			canonicalRequest: "GET\n/\n%E1%88%B4=bar\n" + v4TestHeader + "\nhost;x-amz-date\n" + v4EmptyPayloadHash,
+			signature:        "2cdec8eed098649ff3a119c94853b13c643bcf08f8b0a1d91e12c9027818dd04",
+		},
+		{
+			name:   "post-vanilla",
+			method: "POST", path: "/",
+			canonicalRequest: "POST\n/\n\n" + v4TestHeader + "\nhost;x-amz-date\n" + v4EmptyPayloadHash,
+			signature:        "5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b",
+		},
+		{
+			name:   "post-vanilla-query",
+			method: "POST", path: "/", query: "Param1=value1",
+			canonicalRequest: "POST\n/\nParam1=value1\n" + v4TestHeader + "\nhost;x-amz-date\n" + v4EmptyPayloadHash,
+			signature:        "28038455d6de14eafc1f9222cf5aa6f1a96197d7deb8263271d420d138af7f11",
+		},
+		{
+			name:   "post-x-www-form-urlencoded",
+			method: "POST", path: "/",
+			header:      http.Header{"Content-Type": {"application/x-www-form-urlencoded"}},
+			payloadHash: hashHex("Param1=value1"),
+			canonicalRequest: "POST\n/\n\ncontent-type:application/x-www-form-urlencoded\n" + v4TestHeader +
+				"\ncontent-type;host;x-amz-date\n" + hashHex("Param1=value1"),
+			signature: "ff11897932ad3f4e8b18135d722051e5ac45fc38421b1da7b9d196a0fe09473a",
+		},
+		{
+			name:   "normalize-path/get-space",
+			method: "GET", path: "/example space/",
+			canonicalRequest: "GET\n/example%20space/\n\n" + v4TestHeader + "\nhost;x-amz-date\n" + v4EmptyPayloadHash,
+			signature:        "652487583200325589f1fba4c7e578f72c47cb61beeca81406b39ddec1366741",
+		},
+		{
+			name:   "normalize-path/get-unreserved",
+			method: "GET", path: "/-._~0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz",
+			canonicalRequest: "GET\n/-._~0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz\n\n" + v4TestHeader + "\nhost;x-amz-date\n" + v4EmptyPayloadHash,
+			signature:        "07ef7494c76fa4850883e2b006601f940f8a34d404d0cfa977f52a65bbf5f24f",
+		},
+		{
+			name:   "normalize-path/get-utf8",
+			method: "GET", path: "/ሴ",
+			canonicalRequest: "GET\n/%E1%88%B4\n\n" + v4TestHeader + "\nhost;x-amz-date\n" + v4EmptyPayloadHash,
+			signature:        "8318018e0b0f223aa2bbf98705b62bb787dc9c0e678f255a891fd03141be5d85",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := &http.Request{
+				Method: test.method,
+				URL:    &url.URL{Scheme: "https", Host: "example.amazonaws.com", Path: test.path, RawQuery: test.query},
+				Header: make(http.Header),
+			}
+			for k, v := range test.header {
+				req.Header[k] = v
+			}
+
+			payloadHash := test.payloadHash
+			if payloadHash == "" {
+				payloadHash = v4EmptyPayloadHash
+			}
+
+			canonicalRequest, stringToSign := signV4(req, v4TestAuth, "us-east-1", "service", payloadHash, v4TestTime)
+
+			if canonicalRequest != test.canonicalRequest {
+				t.Errorf("canonical request\n%s\nexpected\n%s", canonicalRequest, test.canonicalRequest)
+			}
+
+			expectedStringToSign := "AWS4-HMAC-SHA256\n20150830T123600Z\n" + v4TestScope + "\n" + hashHex(test.canonicalRequest)
+			if stringToSign != expectedStringToSign {
+				t.Errorf("string to sign\n%s\nexpected\n%s", stringToSign, expectedStringToSign)
+			}
+
+			signedHeaders := strings.Split(test.canonicalRequest, "\n")
+			expectedAuthorization := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/" + v4TestScope +
+				", SignedHeaders=" + signedHeaders[len(signedHeaders)-2] +
+				", Signature=" + test.signature
+			if authorization := req.Header.Get("Authorization"); authorization != expectedAuthorization {
+				t.Errorf("authorization\n%s\nexpected\n%s", authorization, expectedAuthorization)
+			}
+		})
+	}
+}
+
+func TestV4CanonicalPath(t *testing.T) {
+	tests := []struct {
+		key      string
+		expected string
+	}{
+		{"a.png", "/b/a.png"},
+		{"dir/a b.png", "/b/dir/a%20b.png"},
+		{"a+b.png", "/b/a%2Bb.png"},
+		{"ሴ/фото.png", "/b/%E1%88%B4/%D1%84%D0%BE%D1%82%D0%BE.png"},
+		{"a%20b.png", "/b/a%2520b.png"},
+		{"a/../b.png", "/b/a/../b.png"},
+		{"a//b.png", "/b/a//b.png"},
+	}
+
+	for _, test := range tests {
+		path := "/b/" + test.key
+
+		//goamz puts the escaped path in Opaque
+		opaque := &url.URL{Scheme: "https", Host: "example.com", Opaque: amazonEscape(path)}
+		if actual := v4CanonicalPath(opaque); actual != test.expected {
+			t.Errorf("opaque %q: %s, expected %s", test.key, actual, test.expected)
+		}
+
+		parsed := &url.URL{Scheme: "https", Host: "example.com", Path: path}
+		if actual := v4CanonicalPath(parsed); actual != test.expected {
+			t.Errorf("path %q: %s, expected %s", test.key, actual, test.expected)
+		}
+	}
+
+	full := &url.URL{Opaque: "//example.com/b/a%20b.png"}
+	if actual := v4CanonicalPath(full); actual != "/b/a%20b.png" {
+		t.Errorf("full opaque form: %s", actual)
+	}
+}
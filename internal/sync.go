@@ -0,0 +1,136 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"github.com/mitchellh/goamz/s3"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// MtimeHeader keeps the modification time of the source in object metadata,
+// as unix seconds.
+const MtimeHeader = "X-Amz-Meta-Mtime"
+
+// ObjectStat is what sync compares to decide whether an object changed.
+type ObjectStat struct {
+	Size  int64
+	Etag  string
+	Mtime time.Time //zero if unknown
+}
+
+// FormatMtime returns the value of MtimeHeader for t.
+func FormatMtime(t time.Time) string {
+	return strconv.FormatInt(t.Unix(), 10)
+}
+
+// parseMtime reads MtimeHeader, fractional seconds are accepted too.
+func parseMtime(header http.Header) (mtime time.Time) {
+	seconds, err := strconv.ParseFloat(header.Get(MtimeHeader), 64)
+	if err == nil {
+		mtime = time.Unix(int64(seconds), 0)
+	}
+	return
+}
+
+// StatFile returns the size and modification time of a local file.
+func StatFile(name string) (stat ObjectStat, err error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return
+	}
+
+	stat.Size = info.Size()
+	stat.Mtime = info.ModTime()
+
+	return
+}
+
+// StatObject returns the size, ETag and stored mtime of key. If lastModified
+// is set, the Last-Modified time is used when no mtime is stored. found is
+// false if the object doesn't exist.
+func StatObject(ctx context.Context, bucket *s3.Bucket, key string, lastModified bool) (stat ObjectStat, found bool, err error) {
+	var s3Err *s3.Error
+
+	header, err := HeadObject(ctx, bucket, key)
+	if errors.As(err, &s3Err) && s3Err.StatusCode == http.StatusNotFound {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	found = true
+
+	stat.Size, err = strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return
+	}
+
+	stat.Etag = NormalizeEtag(header.Get("ETag"))
+	stat.Mtime = parseMtime(header)
+
+	if stat.Mtime.IsZero() && lastModified {
+		stat.Mtime, _ = http.ParseTime(header.Get("Last-Modified"))
+	}
+
+	return
+}
+
+// StatSource returns the stat of a local file or, if sourceIsS3, of the
+// object of the source url.
+func StatSource(ctx context.Context, sourceIsS3 bool, name string, sourceBucket *s3.Bucket) (stat ObjectStat, err error) {
+	if !sourceIsS3 {
+		return StatFile(name)
+	}
+
+	u, err := url.Parse(name)
+	if err != nil {
+		return
+	}
+
+	stat, found, err := StatObject(ctx, sourceBucket, u.Path, true)
+	if err == nil && !found {
+		err = &HttpStatusError{StatusCode: http.StatusNotFound}
+	}
+
+	return
+}
+
+// Unchanged reports whether destination holds the same object as source.
+// Sizes must match, then either the ETags, the stored mtime or the md5 of
+// the source, which is computed by md5 only if needed. With byContent the
+// mtime is not enough.
+func Unchanged(source ObjectStat, destination ObjectStat, md5 func() (string, error), byContent bool) (unchanged bool, err error) {
+	if source.Size != destination.Size {
+		return
+	}
+
+	if source.Etag != "" && source.Etag == destination.Etag {
+		unchanged = true
+		return
+	}
+
+	if !byContent && !source.Mtime.IsZero() && !destination.Mtime.IsZero() && source.Mtime.Unix() == destination.Mtime.Unix() {
+		unchanged = true
+		return
+	}
+
+	//only plain ETags are the md5 of the content
+	if destination.Etag == "" || IsMultipartEtag(destination.Etag) || md5 == nil {
+		return
+	}
+
+	sum, err := md5()
+	if err != nil {
+		return
+	}
+
+	unchanged = sum == destination.Etag
+
+	return
+}
@@ -0,0 +1,39 @@
+package internal
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestUnchanged(t *testing.T) {
+	mtime := time.Unix(1600000000, 0)
+	md5 := func() (string, error) { return "d41d8cd98f00b204e9800998ecf8427e", nil }
+	failed := func() (string, error) { return "", errors.New("read failed") }
+
+	tests := []struct {
+		name        string
+		source      ObjectStat
+		destination ObjectStat
+		md5         func() (string, error)
+		byContent   bool
+		expected    bool
+		failed      bool
+	}{
+		{"size", ObjectStat{Size: 1, Mtime: mtime}, ObjectStat{Size: 2, Mtime: mtime}, md5, false, false, false},
+		{"etag", ObjectStat{Size: 1, Etag: "a"}, ObjectStat{Size: 1, Etag: "a"}, nil, true, true, false},
+		{"mtime", ObjectStat{Size: 1, Mtime: mtime}, ObjectStat{Size: 1, Etag: "b", Mtime: mtime}, nil, false, true, false},
+		{"mtime by content", ObjectStat{Size: 1, Mtime: mtime}, ObjectStat{Size: 1, Etag: "b", Mtime: mtime}, nil, true, false, false},
+		{"md5", ObjectStat{Size: 1}, ObjectStat{Size: 1, Etag: "d41d8cd98f00b204e9800998ecf8427e"}, md5, true, true, false},
+		{"md5 differs", ObjectStat{Size: 1}, ObjectStat{Size: 1, Etag: "b"}, md5, true, false, false},
+		{"multipart etag", ObjectStat{Size: 1}, ObjectStat{Size: 1, Etag: "d41d8cd98f00b204e9800998ecf8427e-2"}, md5, true, false, false},
+		{"md5 failed", ObjectStat{Size: 1}, ObjectStat{Size: 1, Etag: "b"}, failed, true, false, true},
+	}
+
+	for _, test := range tests {
+		unchanged, err := Unchanged(test.source, test.destination, test.md5, test.byContent)
+		if unchanged != test.expected || (err != nil) != test.failed {
+			t.Errorf("%s: unchanged %v, error %v", test.name, unchanged, err)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var DuplicateKeyError = errors.New("a file of another directory has the same key")
+
+var errWalkStopped = errors.New("walk stopped") //returned to filepath.WalkDir when fn of Walk returns false
+
+// WalkOptions control which files Walk reports.
+type WalkOptions struct {
+	FollowSymlinks bool
+	Include        []string //glob patterns; files must match one of them if set
+	Exclude        []string //glob patterns of skipped files and directories
+}
+
+// ValidatePatterns returns an error for the first malformed glob pattern.
+func (o WalkOptions) ValidatePatterns() error {
+	for _, pattern := range append(append([]string{}, o.Include...), o.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("%w: %q", err, pattern)
+		}
+	}
+	return nil
+}
+
+// Walk calls fn for every regular file under root accepted by the options,
+// with its path and its slash separated path relative to root, until fn
+// returns false. Errors of single entries are passed to onError and do not
+// stop the walk. Every real directory is walked once: directories behind
+// followed symlinks are walked after the rest of root, unless the walk got
+// there already.
+func Walk(root string, options WalkOptions, fn func(name string, rel string) bool, onError func(name string, err error)) {
+	visited := make(map[string]bool)
+
+	links := []walkLink{{root, ""}}
+	for len(links) > 0 {
+		link := links[0]
+		found, stopped := walkDir(link.name, link.rel, options, visited, fn, onError)
+		if stopped {
+			return
+		}
+		links = append(links[1:], found...)
+	}
+}
+
+// walkLink is a directory to walk whose files get keys under rel.
+type walkLink struct {
+	name string
+	rel  string
+}
+
+// walkDir walks dir and returns the symlinks to directories it found, and
+// whether fn stopped the walk.
+func walkDir(dir string, relDir string, options WalkOptions, visited map[string]bool, fn func(name string, rel string) bool, onError func(name string, err error)) (links []walkLink, stopped bool) {
+	//the walk goes over real paths, so directories behind symlinks are entered
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		onError(dir, err)
+		return
+	}
+
+	err = filepath.WalkDir(real, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			onError(name, err)
+			return nil
+		}
+
+		rel, _ := filepath.Rel(real, name)
+		rel = path.Join(relDir, filepath.ToSlash(rel))
+
+		//a directory may be reached by a symlink and its own path, or by a loop
+		if d.IsDir() {
+			if visited[name] {
+				return filepath.SkipDir
+			}
+			visited[name] = true
+		}
+
+		if name == real {
+			return nil
+		}
+
+		if matchAny(options.Exclude, rel) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if d.Type()&fs.ModeSymlink != 0 {
+			if !options.FollowSymlinks {
+				return nil
+			}
+
+			info, statErr := os.Stat(name)
+			if statErr != nil {
+				onError(name, statErr)
+				return nil
+			}
+
+			if info.IsDir() {
+				links = append(links, walkLink{name, rel})
+				return nil
+			}
+
+			if info.Mode().IsRegular() && included(options, rel) && !fn(name, rel) {
+				return errWalkStopped
+			}
+			return nil
+		}
+
+		if d.Type().IsRegular() && included(options, rel) && !fn(name, rel) {
+			return errWalkStopped
+		}
+
+		return nil
+	})
+
+	stopped = err == errWalkStopped
+
+	return
+}
+
+func included(options WalkOptions, rel string) bool {
+	return len(options.Include) == 0 || matchAny(options.Include, rel)
+}
+
+// matchAny reports whether rel matches one of patterns. Patterns without
+// a slash are matched against the base name only.
+func matchAny(patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		name := rel
+		if !strings.Contains(pattern, "/") {
+			name = path.Base(rel)
+		}
+
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// walkTree makes files and symlinks under a new directory. Entries ending
+// with "/" are directories, "name>target" are symlinks.
+func walkTree(t *testing.T, entries ...string) string {
+	root, err := ioutil.TempDir("", "walk")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, entry := range entries {
+		var err error
+		switch {
+		case strings.Contains(entry, ">"):
+			parts := strings.SplitN(entry, ">", 2)
+			err = os.Symlink(parts[1], filepath.Join(root, parts[0]))
+		case strings.HasSuffix(entry, "/"):
+			err = os.MkdirAll(filepath.Join(root, entry), 0777)
+		default:
+			err = ioutil.WriteFile(filepath.Join(root, entry), []byte(entry), 0666)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return root
+}
+
+func walkRels(t *testing.T, root string, options WalkOptions) []string {
+	var rels []string
+	Walk(root, options, func(name string, rel string) bool {
+		rels = append(rels, rel)
+		return true
+	}, func(name string, err error) {
+		t.Errorf("%s: %v", name, err)
+	})
+	sort.Strings(rels)
+	return rels
+}
+
+func TestWalk(t *testing.T) {
+	tests := []struct {
+		name     string
+		entries  []string
+		dir      string //walked directory of the tree
+		options  WalkOptions
+		expected []string
+	}{
+		{
+			"plain",
+			[]string{"a/", "a/1.txt", "b.txt", "c.tmp"},
+			"",
+			WalkOptions{Exclude: []string{"*.tmp"}},
+			[]string{"a/1.txt", "b.txt"},
+		},
+		{
+			"include",
+			[]string{"a/", "a/1.txt", "a/2.png", "b.png"},
+			"",
+			WalkOptions{Include: []string{"*.png"}},
+			[]string{"a/2.png", "b.png"},
+		},
+		{
+			"symlinks not followed",
+			[]string{"a/", "a/1.txt", "z>a", "l.txt>a/1.txt"},
+			"",
+			WalkOptions{},
+			[]string{"a/1.txt"},
+		},
+		{
+			//the link sorts before the directory it points to
+			"link to a sibling walked once",
+			[]string{"b/", "b/1.txt", "a>b"},
+			"",
+			WalkOptions{FollowSymlinks: true},
+			[]string{"b/1.txt"},
+		},
+		{
+			"link to a directory outside",
+			[]string{"in/", "out/", "out/1.txt", "in/link>../out"},
+			"in",
+			WalkOptions{FollowSymlinks: true},
+			[]string{"link/1.txt"},
+		},
+		{
+			"loop",
+			[]string{"a/", "a/1.txt", "a/up>.."},
+			"",
+			WalkOptions{FollowSymlinks: true},
+			[]string{"a/1.txt"},
+		},
+		{
+			"file link",
+			[]string{"a.txt", "l.txt>a.txt"},
+			"",
+			WalkOptions{FollowSymlinks: true},
+			[]string{"a.txt", "l.txt"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := walkTree(t, test.entries...)
+			defer os.RemoveAll(root)
+
+			rels := walkRels(t, filepath.Join(root, test.dir), test.options)
+			if strings.Join(rels, ",") != strings.Join(test.expected, ",") {
+				t.Errorf("walked %v, expected %v", rels, test.expected)
+			}
+		})
+	}
+}
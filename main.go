@@ -2,55 +2,165 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"github.com/blackbass1988/s3uploader/internal"
+	"github.com/blackbass1988/s3uploader/uploader"
+	"github.com/mitchellh/goamz/aws"
 	"github.com/mitchellh/goamz/s3"
 	"io"
 
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"math"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
 	"runtime"
 	"runtime/pprof"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 var (
-	currentRoutineSize uint64 = 0
-	fileTotal          uint64 = 0
-	fileCount          uint64 = 0
-	totalTransferred   uint64 = 0
+	inputRead   uint32 = 0 //set when all lines are queued
+	errorCount  uint64 = 0 //errors written to the error log
+	failedBytes uint64 = 0 //sizes of failed sources, counted by the prescan
+
+	prescanMode    bool   //count sources and bytes before the upload for percentage and ETA
+	scanDone       uint32 = 0
+	scanFiles      uint64 = 0
+	scanBytes      uint64 = 0 //bytes to upload, journaled and skipped lines excluded
+	scanBytesKnown bool       //false if sizes of sources are unknown
+
+	progress = internal.NewProgress(time.Minute) //rates over the last minute
 
 	offset         uint64 = 0 //how many lines need to skip before start uploading
 	maxRoutineSize int        //concurrency
 	MaxProcCount   int        //max proc mount
 
-	messages chan *Message
-
-	activePool chan bool //active concurrent uploads
-
 	destinationAccessKey, destinationSecretKey, destinationEndpoint string
 	sourceAccessKey, sourceSecretKey, sourceEndpoint                string
+	destinationRegion, destinationSignature                         string
+	destinationUseHttp, sourceUseHttp                               bool
+	destinationScheme, sourceScheme                                 string
+	sourceRegion, sourceSignature                                   string
 
 	destinationBucketName, sourceBucketName string
 
-	errorLog string //filename of error log
+	configFile, profileName                   string
+	sourceProfileName, destinationProfileName string
+
+	errorLog     string //filename of error log
+	errorLogFile *os.File
+	errorLogMu   sync.Mutex
+
+	journalFile string //filename of resume journal
+	resume      bool
+	journal     *uploader.Journal
+
+	syncMode bool //skip objects which are the same in the destination
+
+	metadataRules   uploader.MetadataRules
+	metadataInclude stringList
+	metadataExclude stringList
+	metadataSet     stringList
+
+	contentTypes     *uploader.ContentTypes
+	contentTypeRules stringList //pattern=type
+	mimeTypesFile    string
+	defaultType      string
+
+	aclRules    uploader.AclRules //acl of uploaded local files
+	defaultAcl  string
+	aclRuleList stringList
+	bucketAcl   string //acl of buckets made by -create-bucket
+
+	aclGrants   bool //reproduce the grants of source objects instead of a canned ACL
+	ownerMap    string
+	aclOwnerMap uploader.OwnerMap
+
+	moveMode    bool //delete sources after they are copied
+	moveAudit   string
+	deleteBatch int
+	remover     *uploader.Remover
+
+	dryRun               bool //plan uploads without writing to the destination
+	planFile, planFormat string
+	plan                 *uploader.Plan
 
 	inputFile, removeThisStringFromKey                                              string
 	profile, silent, useHttp, createBucket, sourceIsS3, trimAfterQuestionSignOnSave bool
 
+	walkRoots   stringList //upload files of these directories instead of the input file
+	walkOptions internal.WalkOptions
+	walkInclude stringList
+	walkExclude stringList
+
+	listSource                 bool //upload objects listed from the source bucket instead of the input file
+	sourcePrefix, sourceMarker string
+
+	keyRules     stringList //rules mapping source lines to keys, applied in order
+	keyRulesFile string
+	keyMapper    *uploader.KeyMapper
+	mapKeysMode  bool //print keys of the input lines and exit
+
+	retryMode                bool //re-run lines of the error log given as input file
+	retryClasses, retryMatch string
+	retryEntries             []internal.ErrorLogEntry
+
 	sleepAfterUpload time.Duration
+	httpTimeout      time.Duration
+
+	destinationHttpTimeout, sourceHttpTimeout time.Duration //-http-timeout if not set
+
+	bwLimit         string     //bytes per second of all transfers
+	bwLimitEndpoint stringList //endpoint=rate
+	bwLimitFile     string     //limits re-read when the file changes
+	limits          *uploader.Limits
+
+	logFormat string                //text or json
+	events    *internal.EventWriter //set in json log format
+
+	metricsAddr string //serve prometheus metrics on this address
+	metrics     = uploader.NewMetrics()
+
+	retryPolicy uploader.RetryPolicy
+
+	multipartThreshold int64 //objects of this size and larger are uploaded in parts
+	partSize           int64
+	partConcurrency    int
+
+	streamCopy        bool //read and upload objects of the same cluster instead of copying them on the server
+	metadataDirective string
+
+	shutdownTimeout time.Duration //how long running uploads may finish after a signal
+	exitCode        int32         //of the signal which stopped the run, set atomically
+
+	//canceled when running uploads are not waited for anymore
+	uploadContext, cancelUploads = context.WithCancel(context.Background())
+
+	//closed when canceled uploads are not waited for anymore, work() exits
+	forceExit = make(chan struct{})
 
 	//	stats_putBytes uint64 = 0
 )
 
 const (
 	version string = "2.0.0"
+
+	shutdownGrace = 10 * time.Second //how long canceled uploads may take to stop
 )
 
 var (
+	up           *uploader.Uploader
+	job          *uploader.Job
 	destClient   *s3.S3
 	sourceClient *s3.S3
 )
@@ -61,44 +171,155 @@ func main() {
 		curRSize, curTotalSize, curSize, curTotalTransferred uint64
 	)
 
-	fmt.Println("")
-	fmt.Println("~")
-	fmt.Println("~ СоЗФНЭСПГОРНСД", version)
-	fmt.Println("~ СалионоваОлегаЗагружающийФайлыНаЭс3ПосредствомГоРутинНаСервераДрома", version)
-	fmt.Println("~")
-	fmt.Println("")
-
 	/// parse args
 
+	flag.StringVar(&configFile, "config", "", "read settings from this TOML file (default \"~/.s3uploader.toml\" if it exists)")
+	flag.StringVar(&profileName, "profile-name", "", "use settings of this table of the config file")
+	flag.StringVar(&sourceProfileName, "source-profile", "", "use endpoint, bucket, keys, region, signature, scheme and http-timeout of this table of the config file for the source")
+	flag.StringVar(&destinationProfileName, "destination-profile", "", "use endpoint, bucket, keys, region, signature, scheme and http-timeout of this table of the config file for the destination")
+
 	flag.StringVar(&errorLog, "error-log", "error.log", "save errors to this file")
 	flag.StringVar(&inputFile, "i", "", "input file")
+	flag.Var(&walkRoots, "dir", "upload files of this directory instead of the input file, keys are relative to it. May be repeated")
+	flag.Var(&walkInclude, "include", "dir mode: upload only files matching this glob. May be repeated")
+	flag.Var(&walkExclude, "exclude", "dir mode: skip files and directories matching this glob. May be repeated")
+	flag.BoolVar(&listSource, "list-source", false, "copy objects listed from the source bucket instead of the input file")
+	flag.StringVar(&sourcePrefix, "source-prefix", "", "list mode: copy only keys with this prefix")
+	flag.StringVar(&sourceMarker, "source-marker", "", "list mode: start listing after this key")
+	flag.BoolVar(&walkOptions.FollowSymlinks, "follow-symlinks", false, "dir mode: follow symlinks to files and directories")
 	flag.StringVar(&removeThisStringFromKey, "p", "", "removes this string from key on PUT")
+	flag.Var(&keyRules, "key-rule", "key mapping rule, applied in order after -p, -trim-question-sign and -key-rules-file. May be repeated")
+	flag.StringVar(&keyRulesFile, "key-rules-file", "", "read key mapping rules from this file, one per line")
 
 	flag.StringVar(&destinationBucketName, "destination-bucket", "", "destination bucket name")
 	flag.StringVar(&sourceBucketName, "source-bucket", "", "source bucket name. Use destination if empty")
 
 	flag.StringVar(&destinationAccessKey, "destination-access-key", "", "destination access key")
 	flag.StringVar(&destinationSecretKey, "destination-secret-key", "", "destination secret key")
-	flag.StringVar(&destinationEndpoint, "destination-endpoint", "", "destination endpoint")
+	flag.StringVar(&destinationEndpoint, "destination-endpoint", "", "destination endpoint, a http:// or https:// prefix overrides -use-http")
 
 	flag.StringVar(&sourceAccessKey, "source-access-key", "", "source access key. Use destination if empty")
 	flag.StringVar(&sourceSecretKey, "source-secret-key", "", "source secret key. Use destination if empty")
-	flag.StringVar(&sourceEndpoint, "source-endpoint", "", "source endpoint. Use destination if empty")
-
-	flag.Uint64Var(&offset, "offset", uint64(0), "count of lines to skip before start upload")
+	flag.StringVar(&sourceEndpoint, "source-endpoint", "", "source endpoint, a http:// or https:// prefix overrides -use-http. Use destination if empty")
+
+	flag.StringVar(&destinationRegion, "destination-region", "squid1", "destination region name")
+	flag.StringVar(&destinationSignature, "destination-signature", uploader.SignatureV2, "destination signature version: v2 or v4")
+	flag.StringVar(&sourceRegion, "source-region", "", "source region name. Use destination if empty")
+	flag.StringVar(&sourceSignature, "source-signature", "", "source signature version: v2 or v4. Use destination if empty")
+	flag.StringVar(&destinationScheme, "destination-scheme", "", "destination scheme: http or https. -use-http if empty")
+	flag.StringVar(&sourceScheme, "source-scheme", "", "source scheme: http or https. Use destination if empty")
+	flag.DurationVar(&destinationHttpTimeout, "destination-http-timeout", 0, "abort requests to the destination idle for this long. -http-timeout if not set")
+	flag.DurationVar(&sourceHttpTimeout, "source-http-timeout", 0, "abort requests to the source idle for this long. -http-timeout if not set")
+
+	flag.Uint64Var(&offset, "offset", uint64(0), "count of lines to skip before start upload. Deprecated, use -resume")
+	flag.BoolVar(&prescanMode, "prescan", false, "count sources and their size first to show percentage and ETA")
+	flag.StringVar(&journalFile, "journal", "", "save completed lines to this file (default \"<input file>.journal\")")
+	flag.BoolVar(&resume, "resume", false, "skip lines recorded as completed in the journal")
+
+	flag.BoolVar(&syncMode, "sync", false, "skip objects of the same size and content or mtime in the destination")
+
+	flag.Var(&metadataInclude, "meta-include", "copy only source headers matching this glob, like x-amz-meta-*. May be repeated")
+	flag.Var(&metadataExclude, "meta-exclude", "don't copy source headers matching this glob. May be repeated")
+	flag.Var(&metadataSet, "meta-set", "set this header on uploads as name=value, an empty value removes it. May be repeated")
+
+	flag.Var(&contentTypeRules, "content-type", "content type of keys matching a pattern as pattern=type, like *.map=application/json. The first matching rule wins over the type of the source object, which wins over the extension unless it's application/octet-stream, binary/octet-stream or text/plain. May be repeated")
+	flag.StringVar(&mimeTypesFile, "mime-types", "", "add the types of extensions of this mime.types file")
+	flag.StringVar(&defaultType, "default-content-type", "", "content type of objects recognized by no rule, source object type, extension or content, instead of application/octet-stream")
+
+	flag.StringVar(&defaultAcl, "default-acl", string(s3.Private), "canned ACL of uploaded local files, public-read keeps the ACL of older versions")
+	flag.Var(&aclRuleList, "acl-rule", "canned ACL of local files matching a pattern as pattern=acl, like docs/private/*.pdf=private. The first matching rule wins. May be repeated")
+	flag.StringVar(&bucketAcl, "bucket-acl", string(s3.Private), "canned ACL of buckets made by -create-bucket")
+	flag.BoolVar(&aclGrants, "acl-grants", false, "copy all ACL grants of source objects with x-amz-grant-* headers instead of a canned ACL")
+	flag.StringVar(&ownerMap, "acl-owner-map", "", "acl-grants: map canonical user IDs of the source to the destination with \"sourceID destinationID\" lines of this file")
+
+	flag.BoolVar(&moveMode, "move", false, "delete the source file or object after it's copied and verified")
+	flag.StringVar(&moveAudit, "move-audit", "move.log", "move mode: record deleted sources to this file")
+	flag.IntVar(&deleteBatch, "delete-batch", uploader.MaxDeleteBatch, "move mode: delete source objects in batches of this size (max 1000)")
+
+	flag.BoolVar(&dryRun, "dry-run", false, "don't write to the destination, save the plan of uploads instead")
+	flag.StringVar(&planFile, "plan", "-", "dry run: save the plan to this file, \"-\" is stdout")
+	flag.StringVar(&planFormat, "plan-format", uploader.PlanFormatCsv, "dry run: plan format, csv or json")
 
 	flag.IntVar(&MaxProcCount, "max-proc", 1, "max proc count")
 	flag.IntVar(&maxRoutineSize, "c", 20, "concurrency")
 
 	flag.BoolVar(&silent, "silent", false, "minimalizing logs")
+	flag.StringVar(&logFormat, "log-format", internal.LogFormatText, "log format: text or json lines of events")
 	flag.BoolVar(&profile, "profile", false, "save profiling to profile.prof on exit")
-	flag.BoolVar(&useHttp, "use-http", false, "use http instead https")
+	flag.BoolVar(&useHttp, "use-http", false, "use http instead https for endpoints without a scheme")
 	flag.BoolVar(&createBucket, "create-bucket", false, "create bucket if it not exists")
 	flag.BoolVar(&trimAfterQuestionSignOnSave, "trim-question-sign", false, "removes char \"?\" and after on save")
 
 	flag.DurationVar(&sleepAfterUpload, "sleep", time.Nanosecond, "sleep after upload")
+	flag.StringVar(&bwLimit, "bwlimit", "0", "limit all transfers to this many bytes per second, K, M and G suffixes are allowed. 0 is unlimited")
+	flag.Var(&bwLimitEndpoint, "bwlimit-endpoint", "limit transfers from or to an endpoint, as endpoint=rate. May be repeated")
+	flag.StringVar(&bwLimitFile, "bwlimit-file", "", "re-read limits from this file when it changes: a line with the rate of all transfers and endpoint=rate lines, over -bwlimit and -bwlimit-endpoint")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "serve prometheus metrics at /metrics on this address, like :9100")
+	flag.DurationVar(&httpTimeout, "http-timeout", 5*time.Second, "abort requests idle for this long. 0 disables")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "on SIGINT or SIGTERM wait this long for running uploads before canceling them")
+
+	flag.IntVar(&retryPolicy.MaxAttempts, "max-attempts", 5, "max attempts to upload a file on retryable errors")
+	flag.DurationVar(&retryPolicy.BaseDelay, "retry-delay", 500*time.Millisecond, "base delay between attempts, doubled on every retry")
+	flag.DurationVar(&retryPolicy.MaxDelay, "retry-max-delay", 30*time.Second, "max delay between attempts")
+
+	flag.StringVar(&retryClasses, "retry-class", "", "retry mode: comma separated error classes to retry (default all)")
+	flag.StringVar(&retryMatch, "retry-match", "", "retry mode: retry only errors matching this regexp")
+
+	flag.Int64Var(&multipartThreshold, "multipart-threshold", 64*1024*1024, "use multipart upload for files of this size in bytes and larger")
+	flag.Int64Var(&partSize, "part-size", 16*1024*1024, "multipart upload part size in bytes (min 5MB)")
+	flag.IntVar(&partConcurrency, "part-concurrency", 4, "parallel part uploads per file")
+	flag.BoolVar(&streamCopy, "stream-copy", false, "read and upload source objects even if source and destination share endpoint and credentials, instead of copying them on the server")
+	flag.StringVar(&metadataDirective, "metadata-directive", uploader.MetadataDirectiveReplace, "server side copy: REPLACE sets the same headers as an upload, COPY keeps the metadata of the source and its mtime")
+
+	//"retry" mode re-runs source lines of an error log given with -i,
+	//"map-keys" mode prints keys of lines of -i or stdin
+	if len(os.Args) > 1 && os.Args[1] == "retry" {
+		retryMode = true
+		flag.CommandLine.Parse(os.Args[2:])
+	} else if len(os.Args) > 1 && os.Args[1] == "map-keys" {
+		mapKeysMode = true
+		flag.CommandLine.Parse(os.Args[2:])
+	} else {
+		flag.Parse()
+	}
+
+	if err := applyConfig(); err != nil {
+		fmt.Println("config:", err)
+		os.Exit(1)
+	}
 
-	flag.Parse()
+	if err := setupKeyMapper(); err != nil {
+		fmt.Println(err)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if mapKeysMode {
+		mapKeys()
+		os.Exit(0)
+	}
+
+	//the banner goes to stderr with the log, stdout may be the plan
+	switch logFormat {
+	case internal.LogFormatText:
+		fmt.Fprintln(os.Stderr, "")
+		fmt.Fprintln(os.Stderr, "~")
+		fmt.Fprintln(os.Stderr, "~ СоЗФНЭСПГОРНСД", version)
+		fmt.Fprintln(os.Stderr, "~ СалионоваОлегаЗагружающийФайлыНаЭс3ПосредствомГоРутинНаСервераДрома", version)
+		fmt.Fprintln(os.Stderr, "~")
+		fmt.Fprintln(os.Stderr, "")
+	case internal.LogFormatJson:
+		//every log line becomes an event
+		events = internal.NewEventWriter(os.Stderr)
+		log.SetFlags(0)
+		log.SetOutput(events.LogWriter())
+	default:
+		fmt.Printf("unknown log format %q\n", logFormat)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	applyCredentialFallbacks()
 
 	/// eo parse args
 
@@ -114,12 +335,73 @@ func main() {
 
 	}
 
-	if inputFile == "" {
+	if inputFile == "" && len(walkRoots) == 0 && !listSource {
 		fmt.Println("input file is empty")
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
+	if len(walkRoots) > 0 && (inputFile != "" || retryMode) {
+		fmt.Println("-dir can't be used with input file")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if listSource && (inputFile != "" || retryMode || len(walkRoots) > 0) {
+		fmt.Println("-list-source can't be used with input file or -dir")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	walkOptions.Include = walkInclude
+	walkOptions.Exclude = walkExclude
+
+	metadataRules.Include = metadataInclude
+	metadataRules.Exclude = metadataExclude
+	metadataRules.Override = make(http.Header)
+
+	for _, v := range metadataSet {
+		name, value, err := internal.ParseHeaderOverride(v)
+		if err != nil {
+			fmt.Println("meta-set:", err)
+			flag.PrintDefaults()
+			os.Exit(1)
+		}
+		metadataRules.Override[name] = []string{value}
+	}
+
+	if err := setupContentTypes(); err != nil {
+		fmt.Println(err)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if err := setupAclRules(); err != nil {
+		fmt.Println(err)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if ownerMap != "" {
+		var err error
+		if aclOwnerMap, err = uploader.LoadOwnerMap(ownerMap); err != nil {
+			fmt.Println("acl-owner-map:", err)
+			os.Exit(1)
+		}
+	}
+
+	if err := metadataRules.ValidatePatterns(); err != nil {
+		fmt.Println(err)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if err := walkOptions.ValidatePatterns(); err != nil {
+		fmt.Println(err)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
 	if destinationAccessKey == "" {
 		fmt.Println("destinationAccessKey is empty")
 		flag.PrintDefaults()
@@ -138,46 +420,399 @@ func main() {
 		os.Exit(1)
 	}
 
+	if sourceScheme == "" {
+		sourceScheme = destinationScheme
+	}
+
+	for _, scheme := range []string{destinationScheme, sourceScheme} {
+		if scheme != "" && scheme != internal.SchemeHttp && scheme != internal.SchemeHttps {
+			fmt.Printf("unknown scheme %q\n", scheme)
+			flag.PrintDefaults()
+			os.Exit(1)
+		}
+	}
+
+	destinationEndpoint, destinationUseHttp = internal.SplitEndpoint(destinationEndpoint, destinationScheme, useHttp)
+	sourceEndpoint, sourceUseHttp = internal.SplitEndpoint(sourceEndpoint, sourceScheme, useHttp)
+
+	if !isFlagSet("destination-http-timeout") {
+		destinationHttpTimeout = httpTimeout
+	}
+
+	if !isFlagSet("source-http-timeout") {
+		sourceHttpTimeout = httpTimeout
+	}
+
 	if sourceEndpoint != "" {
 		sourceIsS3 = true
-		fmt.Println("sourceBucketName and sourceEndpoint is set. Will be use s3-s3 copy mode")
+		log.Println("sourceBucketName and sourceEndpoint is set. Will be use s3-s3 copy mode")
+	}
+
+	if listSource && !sourceIsS3 {
+		fmt.Println("-list-source requires sourceEndpoint")
+		flag.PrintDefaults()
+		os.Exit(1)
 	}
 
 	if sourceBucketName == "" {
 		sourceBucketName = destinationBucketName
-		fmt.Println("sourceBucketName not set. Use destinationBucketName")
+		log.Println("sourceBucketName not set. Use destinationBucketName")
 	}
 
 	if sourceAccessKey == "" {
 		sourceAccessKey = destinationAccessKey
-		fmt.Println("sourceAccessKey not set. Use destinationAccessKey")
+		log.Println("sourceAccessKey not set. Use destinationAccessKey")
 	}
 
 	if sourceSecretKey == "" {
 		sourceSecretKey = destinationSecretKey
-		fmt.Println("sourceSecretKey not set. Use destinationSecretKey")
+		log.Println("sourceSecretKey not set. Use destinationSecretKey")
+	}
+
+	if sourceRegion == "" {
+		sourceRegion = destinationRegion
+	}
+
+	if sourceSignature == "" {
+		sourceSignature = destinationSignature
+	}
+
+	for _, signature := range []string{destinationSignature, sourceSignature} {
+		if signature != uploader.SignatureV2 && signature != uploader.SignatureV4 {
+			fmt.Printf("unknown signature version %q\n", signature)
+			flag.PrintDefaults()
+			os.Exit(1)
+		}
+	}
+
+	if err := setupLimits(); err != nil {
+		fmt.Println(err)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if partSize < internal.MinPartSize {
+		fmt.Println("part-size is less than 5MB")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if metadataDirective != uploader.MetadataDirectiveCopy && metadataDirective != uploader.MetadataDirectiveReplace {
+		fmt.Println(uploader.InvalidMetadataDirectiveError)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if journalFile == "" && inputFile != "" {
+		journalFile = inputFile + ".journal"
+	} else if journalFile == "" {
+		journalFile = "s3uploader.journal"
+	}
+
+	if retryMode {
+		var match *regexp.Regexp
+
+		classes, err := internal.ParseErrorClasses(retryClasses)
+		if err != nil {
+			fmt.Println(err)
+			flag.PrintDefaults()
+			os.Exit(1)
+		}
+
+		if retryMatch != "" {
+			if match, err = regexp.Compile(retryMatch); err != nil {
+				fmt.Println("retry-match is invalid:", err)
+				flag.PrintDefaults()
+				os.Exit(1)
+			}
+		}
+
+		//the whole log is read before start, as new errors may be appended to it
+		if retryEntries, err = internal.ReadErrorLog(inputFile, classes, match); err != nil {
+			log.Fatalln("error while read", inputFile, err)
+		}
 	}
 
 	runtime.GOMAXPROCS(MaxProcCount)
 
-	destClient = getDestinationS3Client()
-	sourceClient = getSourceS3Client()
+	var err error
+
+	up, err = uploader.New(uploader.Options{
+		Destination: uploader.ClientConfig{
+			UseHttp:          destinationUseHttp,
+			AccessKey:        destinationAccessKey,
+			SecretKey:        destinationSecretKey,
+			Endpoint:         destinationEndpoint,
+			Region:           destinationRegion,
+			SignatureVersion: destinationSignature,
+			MaxIdleConns:     maxRoutineSize,
+			Timeout:          destinationHttpTimeout,
+		},
+		DestinationBucket: destinationBucketName,
+		Source: uploader.ClientConfig{
+			UseHttp:          sourceUseHttp,
+			AccessKey:        sourceAccessKey,
+			SecretKey:        sourceSecretKey,
+			Endpoint:         sourceEndpoint,
+			Region:           sourceRegion,
+			SignatureVersion: sourceSignature,
+			MaxIdleConns:     maxRoutineSize,
+			Timeout:          sourceHttpTimeout,
+		},
+		SourceBucket:       sourceBucketName,
+		MultipartThreshold: multipartThreshold,
+		PartSize:           partSize,
+		PartConcurrency:    partConcurrency,
+		Retry:              retryPolicy,
+		Sync:               syncMode,
+		SyncByContent:      moveMode,
+		StreamCopy:         streamCopy,
+		MetadataDirective:  metadataDirective,
+		Metadata:           metadataRules,
+		ContentTypes:       contentTypes,
+		Acl:                aclRules,
+		AclGrants:          aclGrants,
+		OwnerMap:           aclOwnerMap,
+		Limits:             limits,
+		Metrics:            metrics,
+	})
+	if err != nil {
+		log.Fatalln("ERROR while uploader setup", err)
+	}
+
+	destClient = up.Destination().S3
+	sourceClient = up.Source().S3
+
+	if sourceIsS3 && up.ServerSideCopy() {
+		log.Println("source and destination share endpoint and credentials. Will be copy objects on the server")
+	}
+
+	if dryRun {
+		var out io.WriteCloser = nopWriteCloser{os.Stdout}
+		if planFile != "-" {
+			if out, err = os.Create(planFile); err != nil {
+				log.Fatalln("ERROR while plan open", err)
+			}
+		}
+
+		if plan, err = uploader.NewPlan(out, planFormat); err != nil {
+			log.Fatalln("ERROR while plan open", err)
+		}
+	} else {
+		checkAndCreateBucket(destClient, destinationBucketName)
+		checkAndCreateBucket(sourceClient, sourceBucketName)
+	}
+
+	if moveMode && !dryRun {
+		remover, err = uploader.NewRemover(moveAudit, sourceClient.Bucket(sourceBucketName), deleteBatch, retryPolicy)
+		if err != nil {
+			log.Fatalln("ERROR while move audit open", err)
+		}
+	}
+
+	//a dry run only reads the journal to plan the rest of a resumed run
+	if !dryRun || resume {
+		journal, err = uploader.OpenJournal(journalFile, resume)
+		if err != nil {
+			log.Fatalln("ERROR while journal open", err)
+		}
+	}
+
+	if resume {
+		log.Printf("%d completed lines loaded from %s\n", journal.Count(), journalFile)
+	}
 
-	checkAndCreateBucket(destClient, destinationBucketName)
-	checkAndCreateBucket(sourceClient, sourceBucketName)
+	//time placeholders of keys keep the time of the first run on resume
+	if journal != nil {
+		started, err := journal.Started(time.Now())
+		if err != nil {
+			log.Fatalln("ERROR while journal write", err)
+		}
+		keyMapper.Now = func() time.Time { return started }
+	}
 
-	messages = make(chan *Message, maxRoutineSize*2)
-	activePool = make(chan bool, maxRoutineSize)
+	errorLogFile, err = os.OpenFile(errorLog, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		log.Fatalln("ERROR while file open", err)
+	}
+	defer errorLogFile.Close()
+
+	job = uploader.NewJob(up, uploader.JobOptions{
+		Concurrency: maxRoutineSize,
+		Copy:        sourceIsS3,
+		KeyMapper:   keyMapper,
+		Journal:     journal,
+		Resume:      resume,
+		Remover:     remover,
+		Plan:        plan,
+		Sleep:       sleepAfterUpload,
+		OnEvent:     handleEvent,
+	})
+
+	if metricsAddr != "" {
+		serveMetrics(metricsAddr)
+	}
 
-	go saveToBucketFromFile(inputFile, removeThisStringFromKey, destinationBucketName)
+	go handleSignals()
+
+	if prescanMode {
+		go prescan(atomic.LoadUint64(&offset))
+	}
+
+	if retryMode {
+		go saveToBucketFromErrorLog(retryEntries)
+	} else if listSource {
+		go saveToBucketFromBucket(sourcePrefix, sourceMarker)
+	} else if len(walkRoots) > 0 {
+		go saveToBucketFromDirs(walkRoots, walkOptions)
+	} else {
+		go saveToBucketFromFile(inputFile)
+	}
+
+	if events != nil {
+		events.Write(internal.Event{Event: internal.EventStart, Version: version})
+	}
 
 	work(curRSize, curTotalSize, curSize, curTotalTransferred)
 }
 
+// applyConfig sets flags which are not given on the command line from
+// the config file.
+func applyConfig() (err error) {
+	profiles := profileName != "" || sourceProfileName != "" || destinationProfileName != ""
+
+	name := configFile
+	if name == "" {
+		home, homeErr := os.UserHomeDir()
+		if homeErr != nil && profiles {
+			return fmt.Errorf("profiles need a config file: %w", homeErr)
+		} else if homeErr != nil {
+			return
+		}
+
+		name = filepath.Join(home, ".s3uploader.toml")
+		if _, statErr := os.Stat(name); statErr != nil && profiles {
+			return fmt.Errorf("profiles need a config file: %w", statErr)
+		} else if statErr != nil {
+			return
+		}
+	}
+
+	values, err := internal.LoadConfig(name, profileName, map[string]string{
+		"source":      sourceProfileName,
+		"destination": destinationProfileName,
+	})
+	if err != nil {
+		return
+	}
+
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	for k, list := range values {
+		if flag.Lookup(k) == nil {
+			return fmt.Errorf("unknown setting %q in %s", k, name)
+		}
+
+		if explicit[k] {
+			continue
+		}
+
+		//repeatable flags are set once per element of an array
+		for _, v := range list {
+			if err = flag.Set(k, v); err != nil {
+				return fmt.Errorf("invalid value of %q in %s: %w", k, name, err)
+			}
+		}
+	}
+
+	return
+}
+
+// isFlagSet reports whether the flag name was given on the command line or
+// in the config file.
+func isFlagSet(name string) (set bool) {
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return
+}
+
+// applyCredentialFallbacks fills keys not given by flags or the config file
+// from S3UPLOADER_* variables, then from AWS_* variables and
+// ~/.aws/credentials.
+func applyCredentialFallbacks() {
+	fromEnv := func(value *string, name string) {
+		if *value == "" {
+			*value = os.Getenv(name)
+		}
+	}
+
+	fromEnv(&destinationAccessKey, "S3UPLOADER_DESTINATION_ACCESS_KEY")
+	fromEnv(&destinationSecretKey, "S3UPLOADER_DESTINATION_SECRET_KEY")
+	fromEnv(&sourceAccessKey, "S3UPLOADER_SOURCE_ACCESS_KEY")
+	fromEnv(&sourceSecretKey, "S3UPLOADER_SOURCE_SECRET_KEY")
+
+	if destinationAccessKey != "" && destinationSecretKey != "" {
+		return
+	}
+
+	auth, err := aws.EnvAuth()
+	if err != nil {
+		auth, err = aws.SharedAuth()
+	}
+
+	if err != nil {
+		return
+	}
+
+	if destinationAccessKey == "" {
+		destinationAccessKey = auth.AccessKey
+	}
+
+	if destinationSecretKey == "" {
+		destinationSecretKey = auth.SecretKey
+	}
+}
+
+// closeOutputs flushes and closes the journal, the move audit and the plan.
+func closeOutputs() {
+	if journal != nil {
+		if err := journal.Close(); err != nil {
+			log.Println("ERROR while journal close", err)
+		}
+	}
+
+	if remover != nil {
+		if err := remover.Close(); err != nil {
+			log.Println("ERROR while move audit close", err)
+		}
+	}
+
+	if plan != nil {
+		log.Println("~ Plan", plan.Totals())
+		if err := plan.Close(); err != nil {
+			log.Println("ERROR while plan close", err)
+		}
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
 func checkAndCreateBucket(s3Client *s3.S3, bucketName string) {
 	if createBucket {
 		bucket := s3Client.Bucket(bucketName)
-		err := bucket.PutBucket(s3.PublicRead)
+		err := bucket.PutBucket(s3.ACL(bucketAcl))
 		if err != nil {
 			panic(err)
 		}
@@ -186,48 +821,19 @@ func checkAndCreateBucket(s3Client *s3.S3, bucketName string) {
 
 func work(curRSize uint64, curTotalSize uint64, curSize uint64, curTotalTransferred uint64) {
 
-	appRunning := false
-
-	errorLogFile, err := os.OpenFile(errorLog, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-	defer errorLogFile.Close()
-
-	if err != nil {
-		log.Fatalln("ERROR while file open", err)
-		os.Exit(2)
-	}
-
 	m := &runtime.MemStats{}
 	c := time.Tick(1 * time.Second)
 	cProfile := time.Tick(30 * time.Second)
-	var message *Message
 
 	for {
-		curRSize = atomic.LoadUint64(&currentRoutineSize)
-		curTotalSize = atomic.LoadUint64(&fileTotal)
-		curSize = atomic.LoadUint64(&fileCount)
-		curTotalTransferred = atomic.LoadUint64(&totalTransferred)
-		//curPutBytes = atomic.LoadUint64(&stats_putBytes)
-
 		select {
-		case message = <-messages:
-			if message.Error != nil {
-				log.Println("ERROR: ", message.Error)
-				_, err = errorLogFile.WriteString(fmt.Sprintf("%s ### %s ### %s\n", time.Now(), message.SourceLine, message.Error))
-
-				if err != nil {
-					log.Fatalln("FATAL! ", err)
-				}
-			}
-
-			if message.String != "" && !silent {
-				log.Println(message.String)
-			}
-
-			if !appRunning {
-				appRunning = true
-			}
-
 		case <-c:
+			stats := job.Stats()
+			curRSize = stats.Running
+			curTotalSize = stats.Queued
+			curSize = stats.Processed
+			curTotalTransferred = stats.Transferred
+
 			if profile {
 				runtime.ReadMemStats(m)
 				log.Printf("~ Goroutines count %d\n", runtime.NumGoroutine())
@@ -238,48 +844,431 @@ func work(curRSize uint64, curTotalSize uint64, curSize uint64, curTotalTransfer
 				log.Printf("~ Memory Mallocs %d\n", m.Mallocs)
 				log.Printf("~ Memory Frees %d\n", m.Frees)
 			}
-			//atomic.SwapUint64(&stats_putBytes, uint64(0))
-
-			log.Printf("~ Processing %d/%d;\n", curSize, curTotalSize)
-
-			if curTotalTransferred > 1073741824 { //gb
-				log.Printf("~ Transferred %.2f GB\n", float32(curTotalTransferred)/1073741824)
-			} else if curTotalTransferred > 1048576 { //mb
-				log.Printf("~ Transferred %.2f MB\n", float32(curTotalTransferred)/1048576)
-			} else if curTotalTransferred > 1024 { //kb
-				log.Printf("~ Transferred %.2f KB\n", float32(curTotalTransferred)/1024)
-			} else { //b
-				log.Printf("~ Transferred %d B\n", curTotalTransferred)
+
+			progress.Add(time.Now(), curSize, curTotalTransferred+stats.SkippedBytes)
+			e := estimate(stats)
+
+			if events != nil {
+				events.Write(internal.Event{
+					Event:       internal.EventProgress,
+					Processed:   curSize,
+					Total:       e.total,
+					Skipped:     stats.Skipped,
+					Transferred: curTotalTransferred,
+					InProgress:  curRSize,
+					TotalBytes:  e.totalBytes,
+					Percent:     e.percent,
+					Rate:        e.rate,
+					AverageRate: e.averageRate,
+					Eta:         e.eta.Seconds(),
+				})
+			} else {
+				logProgress(stats, e)
 			}
 
-			if appRunning && curRSize == uint64(0) && curSize == curTotalSize {
-				os.Exit(0)
+			//a stopping run doesn't wait for the rest of the input
+			interrupted := job.Stopped()
+
+			if (interrupted || atomic.LoadUint32(&inputRead) == 1 && curSize == curTotalSize) && curRSize == uint64(0) {
+				finish(interrupted)
 			}
 
+		case <-forceExit:
+			log.Printf("~ Exiting without %d running uploads\n", job.Stats().Running)
+			finish(true)
+
 		case <-cProfile:
 			if profile {
-				var fHeapProfiling io.Writer
-				fHeapProfiling, err = os.Create("profile_heap.prof")
-				pprof.WriteHeapProfile(fHeapProfiling)
+				fHeapProfiling, err := os.Create("profile_heap.prof")
+				if err == nil {
+					pprof.WriteHeapProfile(fHeapProfiling)
+				}
 			}
 		}
 
 	}
 }
 
-type Message struct {
-	String     string
-	SourceLine string
-	Error      error
+// finish writes the rest of the run and exits: the deletes still queued in
+// move mode, the error log, the summary and the outputs. Uploads which
+// didn't stop on a forced exit are left out.
+func finish(interrupted bool) {
+	job.Flush()
+
+	//uploads left running write no more errors
+	errorLogMu.Lock()
+
+	if err := errorLogFile.Sync(); err != nil {
+		log.Println("ERROR while error log sync", err)
+	}
+
+	logSummary(job.Stats(), interrupted)
+	closeOutputs()
+	os.Exit(int(atomic.LoadInt32(&exitCode)))
+}
+
+// handleSignals stops queueing sources on SIGINT or SIGTERM. Running
+// uploads are canceled after shutdownTimeout or on a second signal, which
+// aborts their multipart uploads. If they don't stop within shutdownGrace
+// or on a third signal, work() finishes the run without them.
+func handleSignals() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-signals
+
+	if sig == syscall.SIGTERM {
+		atomic.StoreInt32(&exitCode, 143)
+	} else {
+		atomic.StoreInt32(&exitCode, 130)
+	}
+
+	job.Stop()
+
+	log.Printf("~ %s received, waiting up to %s for %d running uploads\n", sig, shutdownTimeout, job.Stats().Running)
+
+	select {
+	case <-time.After(shutdownTimeout):
+	case <-signals:
+	}
+
+	log.Println("~ Canceling running uploads")
+	cancelUploads()
+
+	select {
+	case <-time.After(shutdownGrace):
+	case <-signals:
+	}
+
+	close(forceExit)
+}
+
+// progressEstimate is the state of the run shown by the progress line.
+type progressEstimate struct {
+	total       uint64 //sources, the prescanned count once it's known
+	totalBytes  uint64
+	percent     float64 //0 until the prescan is done
+	rate        float64 //bytes per second
+	averageRate float64
+	eta         time.Duration
+	etaKnown    bool
+}
+
+// estimate returns the progress of the run. Percentage and ETA are known
+// after the prescan only, by bytes if sizes of the sources are known and
+// by count otherwise. Bytes of objects skipped in sync mode or failed count
+// as done.
+func estimate(stats uploader.JobStats) (e progressEstimate) {
+	var averageFiles float64
+
+	e.total = stats.Queued
+	e.rate, e.averageRate, averageFiles = progress.Rates()
+
+	if atomic.LoadUint32(&scanDone) == 0 {
+		return
+	}
+
+	files := atomic.LoadUint64(&scanFiles)
+	if files > e.total {
+		e.total = files
+	}
+
+	doneBytes := stats.Transferred + stats.SkippedBytes + atomic.LoadUint64(&failedBytes)
+	e.totalBytes = atomic.LoadUint64(&scanBytes)
+
+	if scanBytesKnown && e.totalBytes > 0 {
+		e.percent = 100 * math.Min(1, float64(doneBytes)/float64(e.totalBytes))
+		if doneBytes < e.totalBytes {
+			e.eta, e.etaKnown = internal.Eta(e.totalBytes-doneBytes, e.averageRate)
+		} else {
+			e.etaKnown = true
+		}
+	} else if e.total > 0 {
+		e.percent = 100 * float64(stats.Processed) / float64(e.total)
+		e.eta, e.etaKnown = internal.Eta(e.total-stats.Processed, averageFiles)
+	}
+
+	return
+}
+
+func logProgress(stats uploader.JobStats, e progressEstimate) {
+	curSize, curTotalTransferred := stats.Processed, stats.Transferred
+
+	percent := ""
+	if atomic.LoadUint32(&scanDone) == 1 {
+		percent = fmt.Sprintf(" %.1f%%", e.percent)
+	}
+
+	if syncMode {
+		log.Printf("~ Processing %d/%d;%s skipped %d\n", curSize, e.total, percent, stats.Skipped)
+	} else {
+		log.Printf("~ Processing %d/%d;%s\n", curSize, e.total, percent)
+	}
+
+	eta := ""
+	if e.etaKnown {
+		eta = fmt.Sprintf(", ETA %s", e.eta)
+	} else if prescanMode {
+		eta = ", ETA unknown"
+	}
+	log.Printf("~ Rate %s/s, average %s/s%s\n", internal.FormatBytes(e.rate), internal.FormatBytes(e.averageRate), eta)
+
+	if curTotalTransferred > 1073741824 { //gb
+		log.Printf("~ Transferred %.2f GB\n", float32(curTotalTransferred)/1073741824)
+	} else if curTotalTransferred > 1048576 { //mb
+		log.Printf("~ Transferred %.2f MB\n", float32(curTotalTransferred)/1048576)
+	} else if curTotalTransferred > 1024 { //kb
+		log.Printf("~ Transferred %.2f KB\n", float32(curTotalTransferred)/1024)
+	} else { //b
+		log.Printf("~ Transferred %d B\n", curTotalTransferred)
+	}
+}
+
+// setupKeyMapper creates the key mapper of -p, -trim-question-sign, the
+// rules file and -key-rule, in this order.
+func setupKeyMapper() (err error) {
+	var rules []string
+
+	if removeThisStringFromKey != "" {
+		rules = append(rules, "remove:"+removeThisStringFromKey)
+	}
+
+	if trimAfterQuestionSignOnSave {
+		rules = append(rules, "strip-query")
+	}
+
+	if keyRulesFile != "" {
+		var fileRules []string
+		if fileRules, err = internal.LoadKeyRules(keyRulesFile); err != nil {
+			return
+		}
+		rules = append(rules, fileRules...)
+	}
+
+	rules = append(rules, keyRules...)
+
+	keyMapper, err = uploader.NewKeyMapper(rules)
+
+	return
+}
+
+// mapKeys prints the key of every line of the input file, or of stdin if
+// there is none, to test the key rules.
+func mapKeys() {
+	var input io.Reader = os.Stdin
+
+	if inputFile != "" {
+		f, err := os.Open(inputFile)
+		if err != nil {
+			log.Fatalln("error while open", inputFile, err)
+		}
+		defer f.Close()
+		input = f
+	}
+
+	scanner := bufio.NewScanner(input)
+	for scanner.Scan() {
+		key, err := keyMapper.Map(scanner.Text())
+		if err != nil {
+			fmt.Printf("%s\tERROR: %s\n", scanner.Text(), err)
+			continue
+		}
+		fmt.Printf("%s\t%s\n", scanner.Text(), key)
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Fatalln("error while read", err)
+	}
+}
+
+// setupLimits creates the bandwidth limits of the flags and starts
+// watching the limits file.
+func setupLimits() error {
+	global, endpoints, err := limitOptions()
+	if err != nil {
+		return err
+	}
+
+	limits = uploader.NewLimits(global, endpoints)
+
+	if bwLimitFile != "" {
+		var modTime time.Time
+		reloadLimits(bwLimitFile, &modTime)
+		go watchLimits(bwLimitFile, modTime)
+	}
+
+	return nil
+}
+
+// limitOptions returns the limits of -bwlimit and -bwlimit-endpoint.
+func limitOptions() (global int64, endpoints map[string]int64, err error) {
+	if global, err = internal.ParseRate(bwLimit); err != nil {
+		return 0, nil, fmt.Errorf("bwlimit: %w", err)
+	}
+
+	endpoints = make(map[string]int64)
+	for _, v := range bwLimitEndpoint {
+		endpoint, rate, err := internal.ParseEndpointRate(v)
+		if err != nil {
+			return 0, nil, fmt.Errorf("bwlimit-endpoint: %w", err)
+		}
+		endpoints[endpoint] = rate
+	}
+
+	return
+}
+
+// watchLimits applies the limits file every time it changes.
+func watchLimits(name string, modTime time.Time) {
+	for range time.Tick(time.Second) {
+		reloadLimits(name, &modTime)
+	}
+}
+
+func reloadLimits(name string, modTime *time.Time) {
+	info, err := os.Stat(name)
+	if err != nil || info.ModTime().Equal(*modTime) {
+		return
+	}
+	*modTime = info.ModTime()
+
+	global, ok, endpoints, err := internal.LoadLimits(name)
+	if err != nil {
+		log.Println("ERROR while limits read", err)
+		return
+	}
+
+	//the file overrides the options, limits it doesn't set are the ones of
+	//the options
+	optionGlobal, optionEndpoints, _ := limitOptions()
+
+	if !ok {
+		global = optionGlobal
+	}
+
+	for endpoint, rate := range optionEndpoints {
+		if _, found := endpoints[endpoint]; !found {
+			endpoints[endpoint] = rate
+		}
+	}
+
+	limits.Set(global, endpoints)
+	log.Printf("~ Limits set: %d B/s, endpoints %v\n", global, endpoints)
+}
+
+// serveMetrics adds the counters of the run to the metrics and serves them.
+func serveMetrics(addr string) {
+	metrics.Func("files_queued_total", "Sources queued for upload.", "counter", func() float64 {
+		return float64(job.Stats().Queued)
+	})
+	metrics.Func("files_processed_total", "Sources processed, failed ones included.", "counter", func() float64 {
+		return float64(job.Stats().Processed)
+	})
+	metrics.Func("files_skipped_total", "Unchanged sources skipped in sync mode.", "counter", func() float64 {
+		return float64(job.Stats().Skipped)
+	})
+	metrics.Func("transferred_bytes_total", "Bytes of completed uploads.", "counter", func() float64 {
+		return float64(job.Stats().Transferred)
+	})
+	metrics.Func("uploads_in_progress", "Running uploads.", "gauge", func() float64 {
+		return float64(job.Stats().Running)
+	})
+
+	go func() {
+		if err := metrics.Listen(addr); err != nil {
+			log.Fatalln("ERROR while metrics listen", err)
+		}
+	}()
+
+	log.Printf("~ Serving metrics on %s/metrics\n", addr)
+}
+
+// logSummary logs the counters of the run and, if it was interrupted, how
+// to continue it.
+func logSummary(stats uploader.JobStats, interrupted bool) {
+	var resumeHint string
+	if interrupted {
+		resumeHint = "interrupted"
+		if journal != nil {
+			resumeHint = fmt.Sprintf("interrupted, %d lines done in journal %s, run again with -resume to continue", journal.Count(), journalFile)
+		}
+	}
+
+	if events != nil {
+		events.Write(internal.Event{
+			Event:       internal.EventSummary,
+			Processed:   stats.Processed,
+			Total:       stats.Queued,
+			Skipped:     stats.Skipped,
+			Failed:      atomic.LoadUint64(&errorCount),
+			Transferred: stats.Transferred,
+			Message:     resumeHint,
+		})
+		return
+	}
+
+	log.Printf("~ Finished: %d/%d processed, %d skipped, %d errors, %d bytes transferred\n",
+		stats.Processed, stats.Queued, stats.Skipped, atomic.LoadUint64(&errorCount), stats.Transferred)
+
+	if interrupted {
+		log.Printf("~ Run %s\n", resumeHint)
+	}
+}
+
+// logError logs the failed event e and writes it to the error log. Only
+// Source, KeySource, Key, Attempts and Err of e need to be set.
+func logError(e uploader.Event) {
+	class := internal.ClassifyError(e.Err)
+
+	metrics.Error(e.Err)
+	atomic.AddUint64(&errorCount, 1)
+
+	if events != nil {
+		e.Event = uploader.EventFailed
+		e.Error = e.Err.Error()
+		e.Class = string(class)
+		events.Write(e)
+	} else {
+		log.Printf("ERROR: %s (class: %s, attempts: %d)\n", e.Err, class, e.Attempts)
+	}
+
+	errorLogMu.Lock()
+	defer errorLogMu.Unlock()
+
+	_, err := errorLogFile.WriteString(internal.FormatErrorLogLine(time.Now(), e.Source, e.KeySource, e.Err))
+
+	if err != nil {
+		log.Fatalln("FATAL! ", err)
+	}
+}
+
+// logStatus logs a message of the producers unless the run is silent.
+func logStatus(format string, v ...interface{}) {
+	if !silent {
+		log.Printf(format+"\n", v...)
+	}
 }
 
-func saveToBucketFromFile(file string, prefixToTrim string, destBucket string) {
+// stringList is a flag which may be given several times.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func saveToBucketFromFile(file string) {
 	var err error
 	var reader *bufio.Reader
 	var buffer []byte
 	var f *os.File
-	var fileSource, key string
+	var fileSource string
 	var offsetDone bool
+	var lineNumber uint64
 
 	f, err = os.Open(file)
 
@@ -292,10 +1281,9 @@ func saveToBucketFromFile(file string, prefixToTrim string, destBucket string) {
 		reader = nil
 		buffer = []byte{}
 		fileSource = ""
-		key = ""
 
 		if r := recover(); r != nil {
-			fmt.Println("Recovered in saveToBucketFromFile", r)
+			log.Println("Recovered in saveToBucketFromFile", r)
 		}
 
 		f.Close()
@@ -308,19 +1296,21 @@ func saveToBucketFromFile(file string, prefixToTrim string, destBucket string) {
 
 		if err == io.EOF {
 			err = nil
-			messages <- &Message{fmt.Sprintf("File \"%s\" read!", inputFile), "", err}
+			atomic.StoreUint32(&inputRead, 1)
+			logStatus("File \"%s\" read!", inputFile)
 			break
 		} else if err != nil {
-			messages <- &Message{"", "", err}
+			logError(uploader.Event{Err: err})
+			atomic.StoreUint32(&inputRead, 1)
 			break
 		}
 
-		atomic.AddUint64(&fileTotal, uint64(1))
+		lineNumber++
 
 		if !offsetDone {
 
 			if atomic.LoadUint64(&offset) > 0 {
-				atomic.AddUint64(&fileCount, uint64(1))
+				job.AddDone()
 				atomic.AddUint64(&offset, ^uint64(0))
 				continue
 			} else {
@@ -328,95 +1318,297 @@ func saveToBucketFromFile(file string, prefixToTrim string, destBucket string) {
 			}
 		}
 
-		atomic.AddUint64(&currentRoutineSize, uint64(1))
 		fileSource = string(buffer)
-		key = strings.Replace(fileSource, prefixToTrim, "", -1)
-
-		activePool <- true
-		go uploadToS3(destBucket, fileSource, key, activePool)
+		if !job.Add(uploadContext, lineNumber, fileSource, fileSource) {
+			atomic.StoreUint32(&inputRead, 1)
+			logStatus("Reading of file \"%s\" stopped at line %d", inputFile, lineNumber)
+			break
+		}
 
 		fileSource = ""
-		key = ""
-
 	}
 
 }
 
-func uploadToS3(destinationBucketName string, source string, key string, activePool chan bool) {
+// saveToBucketFromErrorLog re-uploads the source lines of the error log
+// entries left after filtering.
+func saveToBucketFromErrorLog(entries []internal.ErrorLogEntry) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Println("Recovered in saveToBucketFromErrorLog", r)
+		}
+	}()
 
-	var (
-		destinationBucket *s3.Bucket
-		startTime         int64
-		filesize          uint64
+	for i, entry := range entries {
+		if !job.Add(uploadContext, uint64(i+1), entry.SourceLine, entry.KeySource) {
+			break
+		}
+	}
 
-		fmeta    internal.FileMeta
-		mimeType string
+	atomic.StoreUint32(&inputRead, 1)
+	logStatus("%d lines of \"%s\" queued for retry", len(entries), inputFile)
+}
 
-		err error
+// saveToBucketFromDirs uploads files found under roots, every root is
+// walked by its own goroutine. A file with the key of a file of another
+// root is not uploaded.
+func saveToBucketFromDirs(roots []string, options internal.WalkOptions) {
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		keys = make(map[string]string) //files of relative paths, with several roots
 	)
 
-	if !silent {
-		startTime = time.Now().Unix()
-	}
+	//the first file found keeps the key
+	duplicate := func(name string, rel string) (other string, found bool) {
+		if len(roots) < 2 {
+			return
+		}
 
-	defer func() {
-		if !silent {
-			messages <- &Message{fmt.Sprintf("\"%s\" -> \"%s\" done. Time elapsed %d sec", source, key, time.Now().Unix()-startTime), "", nil}
+		mu.Lock()
+		defer mu.Unlock()
+
+		if other, found = keys[rel]; !found {
+			keys[rel] = name
 		}
+		return
+	}
 
-		atomic.AddUint64(&totalTransferred, filesize)
-		atomic.AddUint64(&currentRoutineSize, ^uint64(0))
-		atomic.AddUint64(&fileCount, uint64(1))
+	for _, root := range roots {
+		wg.Add(1)
 
-		err = nil
-		destinationBucket = nil
+		go func(root string) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Println("Recovered in saveToBucketFromDirs", r)
+				}
+				wg.Done()
+			}()
+
+			internal.Walk(root, options, func(name string, rel string) bool {
+				if other, found := duplicate(name, rel); found {
+					job.Fail(name, rel, fmt.Errorf("%w: %s", internal.DuplicateKeyError, other))
+					return true
+				}
+
+				return job.Add(uploadContext, 0, name, rel)
+			}, func(name string, err error) {
+				logError(uploader.Event{Source: name, Err: err})
+			})
+		}(root)
+	}
+
+	wg.Wait()
 
+	atomic.StoreUint32(&inputRead, 1)
+	logStatus("Directories \"%s\" walked!", strings.Join(roots, "\", \""))
+}
+
+// saveToBucketFromBucket copies objects of the source bucket under prefix,
+// feeding keys to uploads while the bucket is listed.
+func saveToBucketFromBucket(prefix string, marker string) {
+	defer func() {
 		if r := recover(); r != nil {
-			fmt.Println("Recovered in uploadToS3", r)
+			log.Println("Recovered in saveToBucketFromBucket", r)
 		}
-		<-activePool
 	}()
 
-	destinationBucket = getDestinationS3Client().Bucket(destinationBucketName)
-	sourceBucket := getSourceS3Client().Bucket(sourceBucketName)
+	sourceBucket := sourceClient.Bucket(sourceBucketName)
 
-	if fmeta, err = internal.NewMeta(sourceIsS3, source, sourceBucket); err == nil {
+	err := internal.ListBucket(sourceBucket, prefix, marker, retryPolicy, func(key s3.Key) bool {
+		return job.Add(uploadContext, 0, internal.SourceLineOfKey(key.Key), key.Key)
+	})
 
-		defer fmeta.Reader.Close()
-		_reader := bufio.NewReader(fmeta.Reader)
+	if err != nil {
+		logError(uploader.Event{Err: fmt.Errorf("listing of bucket %s failed: %w", sourceBucketName, err)})
+		atomic.StoreUint32(&inputRead, 1)
+		return
+	}
+
+	atomic.StoreUint32(&inputRead, 1)
+	logStatus("Bucket \"%s\" listed!", sourceBucketName)
+}
 
-		filesize = uint64(fmeta.Filesize)
-		mimeType = fmeta.Mimetype
-		err = destinationBucket.PutReader(key, _reader, fmeta.Filesize, mimeType, fmeta.Acl)
+// prescan counts the sources and the bytes left to upload while the
+// uploads run. Lines done by the journal or skipped by offset are counted
+// as sources but not as bytes. Sizes of s3 sources are only known in list
+// mode, other s3 sources are counted only. A stopping run stops the prescan.
+func prescan(skipLines uint64) {
+	var files, bytes uint64
 
+	known := !sourceIsS3 || listSource
+
+	add := func(lineNumber uint64, source string, size func() int64) {
+		files++
+		if !known || (journal != nil && resume && journal.IsDone(internal.JournalKey(lineNumber, source))) {
+			return
+		}
+		bytes += uint64(size())
+	}
+
+	fileSize := func(name string) func() int64 {
+		return func() int64 {
+			info, err := os.Stat(name)
+			if err != nil {
+				return 0
+			}
+			return info.Size()
+		}
+	}
+
+	switch {
+	case retryMode:
+		for i, entry := range retryEntries {
+			add(uint64(i+1), entry.SourceLine, fileSize(entry.SourceLine))
+		}
+	case listSource:
+		err := internal.ListBucket(sourceClient.Bucket(sourceBucketName), sourcePrefix, sourceMarker, retryPolicy, func(key s3.Key) bool {
+			add(0, internal.SourceLineOfKey(key.Key), func() int64 { return key.Size })
+			return !job.Stopped()
+		})
 		if err != nil {
-			messages <- &Message{"", source, err}
+			log.Println("ERROR while prescan", err)
 			return
 		}
+	case len(walkRoots) > 0:
+		for i := 0; i < len(walkRoots) && !job.Stopped(); i++ {
+			internal.Walk(walkRoots[i], walkOptions, func(name string, rel string) bool {
+				add(0, name, fileSize(name))
+				return !job.Stopped()
+			}, func(name string, err error) {})
+		}
+	default:
+		f, err := os.Open(inputFile)
+		if err != nil {
+			log.Println("ERROR while prescan", err)
+			return
+		}
+		defer f.Close()
+
+		reader := bufio.NewReader(f)
+		for lineNumber := uint64(1); !job.Stopped(); lineNumber++ {
+			buffer, _, err := reader.ReadLine()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				log.Println("ERROR while prescan", err)
+				return
+			}
+
+			if lineNumber <= skipLines {
+				files++
+				continue
+			}
+			add(lineNumber, string(buffer), fileSize(string(buffer)))
+		}
+	}
+
+	//the counts of a stopped prescan are short
+	if job.Stopped() {
+		return
+	}
 
-		time.Sleep(sleepAfterUpload)
+	scanBytesKnown = known
+	atomic.StoreUint64(&scanFiles, files)
+	atomic.StoreUint64(&scanBytes, bytes)
+	atomic.StoreUint32(&scanDone, 1)
 
+	if known {
+		log.Printf("~ Prescan: %d sources, %s to upload\n", files, internal.FormatBytes(float64(bytes)))
 	} else {
-		messages <- &Message{"", source, err}
+		log.Printf("~ Prescan: %d sources\n", files)
+	}
+}
+
+// handleEvent logs an event of the job, failures go to the error log.
+func handleEvent(e uploader.Event) {
+	if e.Event == uploader.EventFailed {
+		logError(e)
+		addFailedBytes(e.Source, e.Err)
+		return
 	}
 
+	if silent {
+		return
+	}
+
+	if events != nil {
+		events.Write(e)
+		return
+	}
+
+	done := "done"
+	if e.Event == uploader.EventPlanned {
+		done = "planned"
+	} else if e.Event == uploader.EventSkipped {
+		done = "unchanged"
+	}
+
+	message := fmt.Sprintf("\"%s\" -> \"%s\" %s. Time elapsed %d sec", e.Source, e.Key, done, int64(e.Duration))
+	if e.MimeSource != "" {
+		message += fmt.Sprintf(". Type %s by %s", e.Mime, e.MimeSource)
+	}
+
+	log.Println(message)
 }
 
-func getDestinationS3Client() (client *s3.S3) {
-	if destClient != nil {
-		return destClient
+// addFailedBytes counts the size of a failed source as done, so the
+// percentage and ETA of the prescan reach the end of the run.
+func addFailedBytes(source string, err error) {
+	if !prescanMode || sourceIsS3 && !listSource || errors.Is(err, context.Canceled) {
+		return
 	}
 
-	destClient = internal.GetS3Client(useHttp, destinationAccessKey, destinationSecretKey, destinationEndpoint, maxRoutineSize)
-	return destClient
+	stat, err := internal.StatSource(uploadContext, sourceIsS3, source, sourceClient.Bucket(sourceBucketName))
+	if err != nil {
+		return
+	}
+
+	atomic.AddUint64(&failedBytes, uint64(stat.Size))
 }
 
-func getSourceS3Client() (client *s3.S3) {
-	if sourceClient != nil {
-		return sourceClient
+// setupContentTypes parses -content-type, -mime-types and
+// -default-content-type.
+func setupContentTypes() (err error) {
+	contentTypes = uploader.NewContentTypes()
+	contentTypes.Default = defaultType
+
+	if mimeTypesFile != "" {
+		if err = contentTypes.LoadMimeTypes(mimeTypesFile); err != nil {
+			return
+		}
 	}
-	sourceClient = internal.GetS3Client(useHttp, sourceAccessKey, sourceSecretKey, sourceEndpoint, maxRoutineSize)
-	return sourceClient
+
+	for _, v := range contentTypeRules {
+		var rule uploader.ContentTypeRule
+		if rule, err = uploader.ParseContentTypeRule(v); err != nil {
+			return
+		}
+		contentTypes.Rules = append(contentTypes.Rules, rule)
+	}
+
+	return
+}
+
+// setupAclRules parses -default-acl, -acl-rule and -bucket-acl.
+func setupAclRules() (err error) {
+	if aclRules.Default, err = uploader.ParseAcl(defaultAcl); err != nil {
+		return
+	}
+
+	if _, err = uploader.ParseAcl(bucketAcl); err != nil {
+		return
+	}
+
+	for _, v := range aclRuleList {
+		var rule uploader.AclRule
+		if rule, err = uploader.ParseAclRule(v); err != nil {
+			return
+		}
+		aclRules.Rules = append(aclRules.Rules, rule)
+	}
+
+	return
 }
 
 func findBucket(client *s3.S3, bucketName string) bool {
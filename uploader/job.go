@@ -0,0 +1,367 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/blackbass1988/s3uploader/internal"
+	"github.com/mitchellh/goamz/s3"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	PlanFormatCsv  = internal.PlanFormatCsv
+	PlanFormatJson = internal.PlanFormatJson
+
+	MaxDeleteBatch = internal.MaxDeleteBatch
+)
+
+// Types of the outputs of a Job, see the internal package for their
+// methods.
+type (
+	KeyMapper = internal.KeyMapper
+	Journal   = internal.Journal
+	Remover   = internal.Remover
+	Plan      = internal.Plan
+)
+
+// NewKeyMapper returns the mapper of key rules like those of -key-rule.
+func NewKeyMapper(rules []string) (*KeyMapper, error) {
+	return internal.NewKeyMapper(rules)
+}
+
+// OpenJournal opens the journal at name. If resume is set, completed lines
+// are loaded from the existing journal, otherwise the journal is truncated.
+func OpenJournal(name string, resume bool) (*Journal, error) {
+	return internal.OpenJournal(name, resume)
+}
+
+// NewRemover returns the remover of move mode, which deletes source
+// objects of bucket in batches and records deleted sources to auditName.
+func NewRemover(auditName string, bucket *s3.Bucket, batch int, retry RetryPolicy) (*Remover, error) {
+	return internal.NewRemover(auditName, bucket, batch, retry)
+}
+
+// NewPlan returns the plan of a dry run written to out in format, csv or
+// json.
+func NewPlan(out io.WriteCloser, format string) (*Plan, error) {
+	return internal.NewPlan(out, format)
+}
+
+// JobOptions configure a Job. Zero values get the defaults of the
+// s3uploader command.
+type JobOptions struct {
+	Concurrency int //concurrent uploads, 20 if 0
+
+	Copy bool //sources are objects of the source bucket, see Uploader.Copy
+
+	KeyMapper *KeyMapper //keys are the key sources if nil
+	Journal   *Journal   //records completed lines if set
+	Resume    bool       //skip lines the journal has completed
+
+	Remover *Remover //move mode: deletes sources once they are uploaded
+	Plan    *Plan    //dry run: plans the uploads instead of running them
+
+	Sleep time.Duration //after every upload
+
+	//called with the done, skipped, planned and failed events of the job,
+	//from several goroutines. Failures of sources which were not uploaded
+	//and of deleting sources are failed events as well
+	OnEvent func(Event)
+}
+
+// JobStats are the counters of a Job.
+type JobStats struct {
+	Queued       uint64 //sources added, failed ones and ones done before included
+	Processed    uint64 //sources done, skipped, failed or completed by the journal
+	Running      uint64 //uploads running or waiting for a slot
+	Skipped      uint64 //unchanged objects skipped in sync mode
+	SkippedBytes uint64
+	Transferred  uint64 //bytes of completed uploads
+	Failed       uint64 //failed events
+}
+
+// Job runs the uploads of sources added to it with an Uploader, the way a
+// run of the s3uploader command does. Its methods may be called from
+// several goroutines.
+type Job struct {
+	//counters of Stats, first for their alignment
+	queued, processed, running     uint64
+	skipped, skippedBytes          uint64
+	transferred, failed, isStopped uint64
+
+	uploader *Uploader
+	options  JobOptions
+	pool     chan bool //active concurrent uploads
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func NewJob(u *Uploader, options JobOptions) *Job {
+	if options.Concurrency <= 0 {
+		options.Concurrency = 20
+	}
+
+	return &Job{
+		uploader: u,
+		options:  options,
+		pool:     make(chan bool, options.Concurrency),
+		stop:     make(chan struct{}),
+	}
+}
+
+// Add starts the upload of the source line with lineNumber to the key
+// mapped from keySource, unless the journal has the line completed. The
+// upload is canceled once ctx is done. Add blocks while all upload slots
+// are busy. False is returned once the job is stopped, the source is not
+// counted then and no more should be added.
+func (j *Job) Add(ctx context.Context, lineNumber uint64, source string, keySource string) (queued bool) {
+	if j.Stopped() {
+		return false
+	}
+
+	atomic.AddUint64(&j.queued, 1)
+
+	journal := j.options.Journal
+	journalKey := internal.JournalKey(lineNumber, source)
+
+	if journal != nil && j.options.Resume && journal.IsDone(journalKey) {
+		atomic.AddUint64(&j.processed, 1)
+		return true
+	}
+
+	key := keySource
+	if j.options.KeyMapper != nil {
+		var err error
+		if key, err = j.options.KeyMapper.Map(keySource); err != nil {
+			j.fail(Event{Source: source, KeySource: keySource}, err)
+			atomic.AddUint64(&j.processed, 1)
+			return true
+		}
+	}
+
+	//uploaded by a previous run which stopped before the source was deleted
+	if journal != nil && j.options.Resume && j.options.Remover != nil && j.options.Plan == nil && journal.IsUploaded(journalKey) {
+		j.move(source, keySource, key, journalKey)
+		atomic.AddUint64(&j.processed, 1)
+		return true
+	}
+
+	atomic.AddUint64(&j.running, 1)
+
+	select {
+	case j.pool <- true:
+	case <-j.stop:
+		atomic.AddUint64(&j.running, ^uint64(0))
+		atomic.AddUint64(&j.queued, ^uint64(0))
+		return false
+	}
+
+	//a slot may be free when the job stops, then either case is chosen
+	if j.Stopped() {
+		<-j.pool
+		atomic.AddUint64(&j.running, ^uint64(0))
+		atomic.AddUint64(&j.queued, ^uint64(0))
+		return false
+	}
+
+	go j.upload(ctx, source, keySource, key, journalKey)
+
+	return true
+}
+
+// AddDone counts a source done before the job, like a line skipped by
+// -offset.
+func (j *Job) AddDone() {
+	atomic.AddUint64(&j.queued, 1)
+	atomic.AddUint64(&j.processed, 1)
+}
+
+// Fail counts a source which is not uploaded because of err, like a file
+// of -dir with the key of another file, and reports it as failed.
+func (j *Job) Fail(source string, keySource string, err error) {
+	atomic.AddUint64(&j.queued, 1)
+	j.fail(Event{Source: source, KeySource: keySource}, err)
+	atomic.AddUint64(&j.processed, 1)
+}
+
+// Stop stops adding sources: Add returns false from now on, waiting ones
+// included. Running uploads are canceled by the contexts given to Add.
+func (j *Job) Stop() {
+	j.stopOnce.Do(func() {
+		atomic.StoreUint64(&j.isStopped, 1)
+		close(j.stop)
+	})
+}
+
+// Stopped reports whether Stop was called.
+func (j *Job) Stopped() bool {
+	return atomic.LoadUint64(&j.isStopped) == 1
+}
+
+// Flush deletes the source objects still queued by the Remover, failures
+// are reported as failed events.
+func (j *Job) Flush() {
+	if j.options.Remover == nil {
+		return
+	}
+
+	for _, failed := range j.options.Remover.Flush() {
+		j.fail(Event{Source: failed.SourceLine, KeySource: failed.KeySource, Attempts: 1}, failed.Err)
+	}
+}
+
+// Stats returns the counters of the job.
+func (j *Job) Stats() JobStats {
+	return JobStats{
+		Queued:       atomic.LoadUint64(&j.queued),
+		Processed:    atomic.LoadUint64(&j.processed),
+		Running:      atomic.LoadUint64(&j.running),
+		Skipped:      atomic.LoadUint64(&j.skipped),
+		SkippedBytes: atomic.LoadUint64(&j.skippedBytes),
+		Transferred:  atomic.LoadUint64(&j.transferred),
+		Failed:       atomic.LoadUint64(&j.failed),
+	}
+}
+
+func (j *Job) upload(ctx context.Context, source string, keySource string, key string, journalKey string) {
+	var (
+		event Event
+		err   error
+	)
+
+	defer func() {
+		if r := recover(); r != nil {
+			j.fail(Event{Source: source, KeySource: keySource, Key: key}, fmt.Errorf("upload panicked: %v", r))
+		}
+
+		atomic.AddUint64(&j.running, ^uint64(0))
+		atomic.AddUint64(&j.processed, 1)
+		<-j.pool
+	}()
+
+	if j.options.Plan != nil {
+		var entry PlanEntry
+		entry, event, err = j.uploader.planEntry(ctx, j.options.Copy, source, key)
+
+		//not planned, the rest of the job isn't either
+		if errors.Is(err, context.Canceled) {
+			return
+		}
+
+		j.emit(event, keySource)
+
+		if err = j.options.Plan.Add(entry); err != nil {
+			j.fail(Event{Source: source, KeySource: keySource, Key: key, Attempts: 1}, err)
+		}
+		return
+	}
+
+	event, err = j.uploader.put(ctx, j.options.Copy, source, key)
+	j.emit(event, keySource)
+
+	if err != nil {
+		return
+	}
+
+	if event.Event == EventSkipped {
+		atomic.AddUint64(&j.skipped, 1)
+		atomic.AddUint64(&j.skippedBytes, uint64(event.Size))
+	} else {
+		atomic.AddUint64(&j.transferred, uint64(event.Size))
+	}
+
+	//the line is done once the source is deleted, which may be batched
+	if j.options.Remover != nil {
+		if err = j.markUploaded(journalKey); err != nil {
+			j.fail(Event{Source: source, KeySource: keySource, Key: key, Attempts: event.Attempts}, err)
+		} else {
+			j.move(source, keySource, key, journalKey)
+		}
+	} else if err = j.markDone(journalKey); err != nil {
+		j.fail(Event{Source: source, KeySource: keySource, Key: key, Attempts: event.Attempts}, err)
+	}
+
+	time.Sleep(j.options.Sleep)
+}
+
+// move deletes source after it was copied to key, mapped from keySource,
+// and completes the line with journalKey once it's deleted. Source objects
+// are deleted in batches, failures of a batch are reported by the upload
+// which sent it.
+func (j *Job) move(source string, keySource string, key string, journalKey string) {
+	remover := j.options.Remover
+
+	deleted := func() {
+		if err := j.markDone(journalKey); err != nil {
+			j.fail(Event{Source: source, KeySource: keySource, Key: key, Attempts: 1}, err)
+		}
+	}
+
+	if !j.options.Copy {
+		if err := remover.RemoveFile(source, source); err != nil {
+			j.fail(Event{Source: source, KeySource: keySource, Key: key, Attempts: 1}, fmt.Errorf("delete source: %w", err))
+			return
+		}
+		deleted()
+		return
+	}
+
+	u, err := url.Parse(source)
+	if err != nil {
+		j.fail(Event{Source: source, KeySource: keySource, Key: key, Attempts: 1}, err)
+		return
+	}
+
+	up := j.uploader
+	if up.options.Source.Endpoint == up.options.Destination.Endpoint && up.source.Name == up.destination.Name && strings.TrimPrefix(u.Path, "/") == strings.TrimPrefix(key, "/") {
+		j.fail(Event{Source: source, KeySource: keySource, Key: key, Attempts: 1}, fmt.Errorf("delete source: %w", SameObjectError))
+		return
+	}
+
+	for _, failed := range remover.RemoveObject(source, keySource, u.Path, deleted) {
+		j.fail(Event{Source: failed.SourceLine, KeySource: failed.KeySource, Attempts: 1}, failed.Err)
+	}
+}
+
+func (j *Job) markDone(journalKey string) error {
+	if j.options.Journal == nil {
+		return nil
+	}
+	return j.options.Journal.MarkDone(journalKey)
+}
+
+func (j *Job) markUploaded(journalKey string) error {
+	if j.options.Journal == nil {
+		return nil
+	}
+	return j.options.Journal.MarkUploaded(journalKey)
+}
+
+// fail passes the failed event of err, with the fields of e, to OnEvent.
+func (j *Job) fail(e Event, err error) {
+	e = failure(e, err)
+	e.Time = time.Now()
+	j.emit(e, e.KeySource)
+}
+
+// emit passes e of the source mapped from keySource to OnEvent.
+func (j *Job) emit(e Event, keySource string) {
+	e.KeySource = ""
+	if keySource != e.Source {
+		e.KeySource = keySource
+	}
+
+	if e.Event == EventFailed {
+		atomic.AddUint64(&j.failed, 1)
+	}
+
+	if j.options.OnEvent != nil {
+		j.options.OnEvent(e)
+	}
+}
@@ -0,0 +1,248 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// nopCloser is a plan output which is not closed.
+type nopCloser struct {
+	*bytes.Buffer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// wait waits until every source added to j is processed.
+func wait(t *testing.T, j *Job) JobStats {
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		stats := j.Stats()
+		if stats.Processed == stats.Queued && stats.Running == 0 {
+			return stats
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("job not done: %+v", stats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestJob(t *testing.T) {
+	f := newFakeS3()
+	defer f.Close()
+
+	dir, err := ioutil.TempDir("", "job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := tempFile(t, dir, "a.txt", "hello")
+	b := tempFile(t, dir, "b.txt", "hi")
+
+	u, err := New(Options{Destination: f.config(), DestinationBucket: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mapper, err := NewKeyMapper([]string{"prefix-add:pre/", "s#^pre/x$##"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	journal, err := OpenJournal(filepath.Join(dir, "journal"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got events
+	j := NewJob(u, JobOptions{Concurrency: 2, KeyMapper: mapper, Journal: journal, OnEvent: got.add})
+
+	for i, line := range []string{a, b, filepath.Join(dir, "missing.txt")} {
+		if !j.Add(context.Background(), uint64(i+1), line, filepath.Base(line)) {
+			t.Fatalf("%s not added", line)
+		}
+	}
+
+	j.Add(context.Background(), 4, "x", "x") //empty key
+	j.Fail("c.txt", "other/c.txt", errors.New("duplicate"))
+	j.AddDone()
+
+	stats := wait(t, j)
+	if expected := (JobStats{Queued: 6, Processed: 6, Failed: 3, Transferred: 7}); stats != expected {
+		t.Errorf("stats %+v, expected %+v", stats, expected)
+	}
+
+	for key, expected := range map[string]string{"/b/pre/a.txt": "hello", "/b/pre/b.txt": "hi"} {
+		if content, _ := f.object(key); string(content) != expected {
+			t.Errorf("object %s %q, expected %q", key, content, expected)
+		}
+	}
+
+	failed := make(map[string]Event)
+	for _, e := range got.all() {
+		if e.Event == EventFailed {
+			failed[e.Source] = e
+		} else if e.Event != EventDone || e.KeySource != filepath.Base(e.Source) {
+			t.Errorf("event %+v", e)
+		}
+	}
+
+	if e := failed[filepath.Join(dir, "missing.txt")]; e.KeySource != "missing.txt" || !errors.Is(e.Err, os.ErrNotExist) {
+		t.Errorf("failed event of the missing file %+v", e)
+	}
+
+	if e := failed["x"]; e.KeySource != "" || !strings.Contains(e.Error, "empty key") {
+		t.Errorf("failed event of the empty key %+v", e)
+	}
+
+	if e := failed["c.txt"]; e.KeySource != "other/c.txt" || e.Error != "duplicate" {
+		t.Errorf("failed event of Fail %+v", e)
+	}
+
+	if err = journal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	//the completed lines are skipped on resume
+	if journal, err = OpenJournal(filepath.Join(dir, "journal"), true); err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+
+	got = events{}
+	j = NewJob(u, JobOptions{KeyMapper: mapper, Journal: journal, Resume: true, OnEvent: got.add})
+
+	for i, line := range []string{a, b} {
+		j.Add(context.Background(), uint64(i+1), line, filepath.Base(line))
+	}
+
+	if stats = wait(t, j); stats.Processed != 2 || stats.Transferred != 0 || len(got.all()) != 0 {
+		t.Errorf("resumed stats %+v, events %+v", stats, got.all())
+	}
+}
+
+func TestJobStop(t *testing.T) {
+	f := newFakeS3()
+	defer f.Close()
+
+	u, err := New(Options{Destination: f.config(), DestinationBucket: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j := NewJob(u, JobOptions{})
+	j.Stop()
+	j.Stop()
+
+	if !j.Stopped() || j.Add(context.Background(), 1, "a.txt", "a.txt") {
+		t.Error("added to a stopped job")
+	}
+
+	if stats := j.Stats(); stats != (JobStats{}) {
+		t.Errorf("stats %+v of a stopped job", stats)
+	}
+}
+
+func TestJobMove(t *testing.T) {
+	f := newFakeS3()
+	defer f.Close()
+
+	dir, err := ioutil.TempDir("", "job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := tempFile(t, dir, "a.txt", "hello")
+
+	u, err := New(Options{Destination: f.config(), DestinationBucket: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	journal, err := OpenJournal(filepath.Join(dir, "journal"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+
+	remover, err := NewRemover(filepath.Join(dir, "audit"), u.Source(), 0, RetryPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remover.Close()
+
+	j := NewJob(u, JobOptions{Journal: journal, Remover: remover})
+	j.Add(context.Background(), 1, a, "a.txt")
+	wait(t, j)
+	j.Flush()
+
+	if content, _ := f.object("/b/a.txt"); string(content) != "hello" {
+		t.Errorf("object %q", content)
+	}
+
+	if _, err = os.Stat(a); !os.IsNotExist(err) {
+		t.Errorf("source not removed: %v", err)
+	}
+
+	if journal.Count() != 1 {
+		t.Errorf("%d lines completed, expected 1", journal.Count())
+	}
+}
+
+func TestJobPlan(t *testing.T) {
+	f := newFakeS3()
+	defer f.Close()
+
+	dir, err := ioutil.TempDir("", "job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := tempFile(t, dir, "a.txt", "hello")
+
+	u, err := New(Options{Destination: f.config(), DestinationBucket: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := nopCloser{&bytes.Buffer{}}
+	plan, err := NewPlan(out, PlanFormatCsv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got events
+	j := NewJob(u, JobOptions{Plan: plan, OnEvent: got.add})
+	j.Add(context.Background(), 1, a, "a.txt")
+	wait(t, j)
+
+	if err = plan.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, found := f.object("/b/a.txt"); found {
+		t.Error("planned upload stored")
+	}
+
+	if !strings.Contains(out.String(), a+",a.txt,5,") {
+		t.Errorf("plan %q", out.String())
+	}
+
+	if all := got.all(); len(all) != 1 || all[0].Event != EventPlanned || all[0].KeySource != "a.txt" {
+		t.Errorf("events %+v", all)
+	}
+}
@@ -0,0 +1,289 @@
+package uploader
+
+import (
+	"bufio"
+	"context"
+	"github.com/blackbass1988/s3uploader/internal"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// contextReader fails reads once ctx is done, so a canceled upload stops
+// sending its body.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (n int, err error) {
+	if err = r.ctx.Err(); err != nil {
+		return
+	}
+	return r.r.Read(p)
+}
+
+// transfer makes a single attempt to copy source to key.
+func (u *Uploader) transfer(ctx context.Context, sourceIsS3 bool, source string, key string) (fmeta internal.FileMeta, err error) {
+	if sourceIsS3 && u.serverSideCopy {
+		return u.copyTransfer(ctx, source, key)
+	}
+
+	fmeta, err = internal.NewMeta(ctx, sourceIsS3, source, key, u.source, u.options.ContentTypes)
+
+	if fmeta.Reader != nil {
+		defer fmeta.Reader.Close()
+	}
+
+	if err != nil {
+		return
+	}
+
+	if !sourceIsS3 {
+		fmeta.Acl = u.options.Acl.Acl(key)
+	}
+
+	u.options.Metrics.InFlight(fmeta.Filesize)
+	defer u.options.Metrics.InFlight(-fmeta.Filesize)
+
+	//md5 of the content known before the upload, sent as Content-MD5. Local
+	//files are read once, their md5 is computed while streaming and checked
+	//against the ETag of the destination
+	var knownMd5 string
+
+	if sourceIsS3 && fmeta.SourceEtag != "" && !internal.IsMultipartEtag(fmeta.SourceEtag) {
+		knownMd5 = fmeta.SourceEtag
+	}
+
+	limits := u.options.Limits
+	destinationEndpoint, sourceEndpoint := u.options.Destination.Endpoint, u.options.Source.Endpoint
+
+	buckets := []*internal.TokenBucket{limits.Global(), limits.Endpoint(destinationEndpoint)}
+	if sourceIsS3 && sourceEndpoint != destinationEndpoint {
+		buckets = append(buckets, limits.Endpoint(sourceEndpoint))
+	}
+
+	_reader := internal.NewMd5Reader(bufio.NewReader(internal.NewLimitedReader(contextReader{ctx, fmeta.Reader}, buckets...)))
+
+	var expectedEtag, destinationEtag string
+
+	headers, err := u.uploadHeaders(fmeta)
+	if err != nil {
+		return
+	}
+
+	if fmeta.Filesize >= u.options.MultipartThreshold {
+		expectedEtag, err = internal.PutMultipart(ctx, u.destination, key, _reader, fmeta.Filesize, headers, u.options.PartSize, u.options.PartConcurrency)
+		if err != nil {
+			return
+		}
+
+		var header http.Header
+		header, err = internal.HeadObject(ctx, u.destination, key)
+		if err != nil {
+			return
+		}
+		destinationEtag = header.Get("ETag")
+	} else {
+		if knownMd5 != "" {
+			headers.Set("Content-MD5", internal.Md5Base64(knownMd5))
+		}
+
+		destinationEtag, err = internal.PutObject(ctx, u.destination, key, _reader, fmeta.Filesize, headers)
+		if err != nil {
+			return
+		}
+		expectedEtag = _reader.Sum()
+	}
+
+	if err = internal.VerifyUpload(_reader.Sum(), knownMd5, fmeta.SourceEtag, expectedEtag, destinationEtag); err != nil {
+		return
+	}
+
+	//a destination which returns no ETag is checked by the size at least
+	if destinationEtag == "" {
+		err = internal.VerifySize(ctx, u.destination, key, fmeta.Filesize)
+	}
+
+	return
+}
+
+// copyTransfer makes a single attempt to copy source to key on the server.
+func (u *Uploader) copyTransfer(ctx context.Context, source string, key string) (fmeta internal.FileMeta, err error) {
+	fmeta, err = internal.NewCopyMeta(ctx, source, key, u.source, u.options.ContentTypes)
+	if err != nil {
+		return
+	}
+
+	u.options.Metrics.InFlight(fmeta.Filesize)
+	defer u.options.Metrics.InFlight(-fmeta.Filesize)
+
+	headers, err := u.uploadHeaders(fmeta)
+	if err != nil {
+		return
+	}
+
+	sourceUrl, err := url.Parse(source)
+	if err != nil {
+		return
+	}
+
+	directive := u.options.MetadataDirective
+	if directive == internal.MetadataDirectiveCopy {
+		headers, directive = internal.KeepSourceMetadata(headers, fmeta)
+	}
+
+	expectedEtag, destinationEtag, err := internal.CopyObject(ctx, u.destination, key, u.source, sourceUrl.Path, fmeta.Filesize, headers, directive, u.options.PartSize, u.options.PartConcurrency)
+	if err != nil {
+		return
+	}
+
+	//a copy in one request keeps the md5 etag of the source
+	if expectedEtag == "" && !internal.IsMultipartEtag(fmeta.SourceEtag) {
+		expectedEtag = fmeta.SourceEtag
+	}
+
+	//the etag of a copy of a source uploaded in parts can't be predicted,
+	//the copy is checked by its size then. Every copy is checked one way,
+	//as -move deletes the source of a verified copy
+	if expectedEtag == "" || destinationEtag == "" {
+		err = internal.VerifySize(ctx, u.destination, key, fmeta.Filesize)
+		return
+	}
+
+	err = internal.VerifyUpload("", "", "", expectedEtag, destinationEtag)
+
+	return
+}
+
+// uploadHeaders returns the headers of the upload of fmeta.
+func (u *Uploader) uploadHeaders(fmeta internal.FileMeta) (headers http.Header, err error) {
+	headers = u.options.Metadata.Filter(fmeta.Headers)
+	headers.Set("Content-Type", fmeta.Mimetype)
+	if err = u.setAcl(headers, fmeta); err != nil {
+		return
+	}
+	if !fmeta.Mtime.IsZero() {
+		headers.Set(internal.MtimeHeader, internal.FormatMtime(fmeta.Mtime))
+	}
+	u.options.Metadata.ApplyOverride(headers)
+
+	return
+}
+
+// setAcl sets the canned ACL of fmeta on headers, or the grants of the
+// source object with AclGrants.
+func (u *Uploader) setAcl(headers http.Header, fmeta internal.FileMeta) (err error) {
+	if u.options.AclGrants && fmeta.AclPolicy != nil {
+		var grants http.Header
+		if grants, err = internal.GrantHeaders(*fmeta.AclPolicy, u.options.OwnerMap); err != nil {
+			return
+		}
+		headers.Del("X-Amz-Acl")
+		for name, values := range grants {
+			headers[name] = values
+		}
+		return
+	}
+
+	if fmeta.Acl == "" {
+		return internal.NotImplementedAclMappingError
+	}
+
+	headers.Set("X-Amz-Acl", string(fmeta.Acl))
+
+	return
+}
+
+// unchanged reports whether key in the destination is the same as source
+// and its size.
+func (u *Uploader) unchanged(ctx context.Context, sourceIsS3 bool, source string, key string) (same bool, size int64, err error) {
+	destination, found, err := internal.StatObject(ctx, u.destination, key, false)
+	if err != nil || !found {
+		return
+	}
+
+	stat, err := internal.StatSource(ctx, sourceIsS3, source, u.source)
+	if err != nil {
+		return
+	}
+
+	var md5 func() (string, error)
+	if !sourceIsS3 {
+		md5 = func() (string, error) {
+			return internal.FileMd5(source)
+		}
+	}
+
+	size = destination.Size
+	same, err = internal.Unchanged(stat, destination, md5, u.options.SyncByContent)
+
+	return
+}
+
+// plan reads what transfer would upload for source, without reading the
+// content: s3 sources are read with HEAD, so their types are not sniffed.
+// Failures are returned in the entry as well.
+func (u *Uploader) plan(ctx context.Context, sourceIsS3 bool, source string, key string) (entry internal.PlanEntry, err error) {
+	var fmeta internal.FileMeta
+
+	entry.Source = source
+	entry.Key = key
+
+	serverSideCopy := sourceIsS3 && u.serverSideCopy
+
+	if sourceIsS3 {
+		fmeta, err = internal.NewCopyMeta(ctx, source, key, u.source, u.options.ContentTypes)
+	} else {
+		fmeta, err = internal.NewMeta(ctx, sourceIsS3, source, key, u.source, u.options.ContentTypes)
+	}
+
+	if fmeta.Reader != nil {
+		fmeta.Reader.Close()
+	}
+
+	if err != nil {
+		entry.Action = internal.PlanActionError
+		entry.Error = err.Error()
+		return
+	}
+
+	if !sourceIsS3 {
+		fmeta.Acl = u.options.Acl.Acl(key)
+	}
+
+	entry.Size = fmeta.Filesize
+	entry.ContentType = fmeta.Mimetype
+	entry.TypeSource = fmeta.MimeSource
+	entry.Acl = string(fmeta.Acl)
+	entry.Action = internal.PlanActionUpload
+
+	if err = u.setAcl(make(http.Header), fmeta); err != nil {
+		entry.Action = internal.PlanActionError
+		entry.Error = err.Error()
+		return
+	}
+	if u.options.AclGrants && fmeta.AclPolicy != nil {
+		entry.Acl = "grants"
+	}
+
+	if serverSideCopy {
+		entry.Action = internal.PlanActionCopy
+	} else if fmeta.Filesize >= u.options.MultipartThreshold {
+		entry.Action = internal.PlanActionMultipart
+	}
+
+	if u.options.Sync {
+		var same bool
+		same, _, err = u.unchanged(ctx, sourceIsS3, source, key)
+
+		if err != nil {
+			entry.Action = internal.PlanActionError
+			entry.Error = err.Error()
+		} else if same {
+			entry.Action = internal.PlanActionSkip
+		}
+	}
+
+	return
+}
@@ -0,0 +1,374 @@
+// Package uploader uploads local files and copies objects to s3 the way the
+// s3uploader command does, for programs which embed it.
+//
+//	u, err := uploader.New(uploader.Options{
+//		Destination:       uploader.ClientConfig{Endpoint: "s3.example.com", AccessKey: "...", SecretKey: "..."},
+//		DestinationBucket: "static",
+//		OnEvent: func(e uploader.Event) {
+//			log.Println(e.Event, e.Source, e.Key, e.Err)
+//		},
+//	})
+//	...
+//	_, err = u.Upload(ctx, "/var/www/static/logo.png", "logo.png")
+//
+// Every request of an upload is canceled once its ctx is done. A Job runs
+// many uploads like a run of the command: concurrently, with keys mapped
+// by a KeyMapper, the Journal of -resume, the Remover of move mode and the
+// Plan of a dry run. Reading the sources is left to the caller, which adds
+// them to the job.
+package uploader
+
+import (
+	"context"
+	"github.com/blackbass1988/s3uploader/internal"
+	"github.com/mitchellh/goamz/s3"
+	"time"
+)
+
+const (
+	EventDone    = internal.EventDone
+	EventSkipped = internal.EventSkipped //unchanged in sync mode
+	EventPlanned = internal.EventPlanned //Plan and dry runs of a Job
+	EventFailed  = internal.EventFailed
+
+	SignatureV2 = internal.SignatureV2
+	SignatureV4 = internal.SignatureV4
+
+	MetadataDirectiveCopy    = internal.MetadataDirectiveCopy
+	MetadataDirectiveReplace = internal.MetadataDirectiveReplace
+
+	PlanActionUpload    = internal.PlanActionUpload
+	PlanActionMultipart = internal.PlanActionMultipart
+	PlanActionCopy      = internal.PlanActionCopy //copied on the server
+	PlanActionSkip      = internal.PlanActionSkip //unchanged in sync mode
+	PlanActionError     = internal.PlanActionError
+)
+
+var (
+	PartSizeTooSmallError         = internal.PartSizeTooSmallError
+	InvalidMetadataDirectiveError = internal.InvalidMetadataDirectiveError
+	ChecksumMismatchError         = internal.ChecksumMismatchError
+	SameObjectError               = internal.SameObjectError
+)
+
+// Types of the options and events, see the internal package for their
+// methods.
+type (
+	ClientConfig    = internal.S3ClientConfig
+	Event           = internal.Event
+	PlanEntry       = internal.PlanEntry
+	RetryPolicy     = internal.RetryPolicy
+	MetadataRules   = internal.MetadataRules
+	ContentTypes    = internal.ContentTypes
+	ContentTypeRule = internal.ContentTypeRule
+	AclRules        = internal.AclRules
+	AclRule         = internal.AclRule
+	OwnerMap        = internal.OwnerMap
+	Limits          = internal.Limits
+	Metrics         = internal.Metrics
+)
+
+// NewLimits returns limits of bytes per second of all transfers and of
+// endpoints, 0 is unlimited. The zero Limits is unlimited.
+func NewLimits(global int64, endpoints map[string]int64) *Limits {
+	return internal.NewLimits(global, endpoints)
+}
+
+// NewMetrics returns empty metrics, the same as the zero Metrics.
+func NewMetrics() *Metrics {
+	return internal.NewMetrics()
+}
+
+// NewContentTypes returns the content types of the extensions known to
+// the command, without rules.
+func NewContentTypes() *ContentTypes {
+	return internal.NewContentTypes()
+}
+
+// ParseContentTypeRule parses a rule of -content-type, pattern=type.
+func ParseContentTypeRule(s string) (ContentTypeRule, error) {
+	return internal.ParseContentTypeRule(s)
+}
+
+// ParseAcl parses a canned ACL like public-read.
+func ParseAcl(s string) (s3.ACL, error) {
+	return internal.ParseAcl(s)
+}
+
+// ParseAclRule parses a rule of -acl-rule, pattern=acl.
+func ParseAclRule(s string) (AclRule, error) {
+	return internal.ParseAclRule(s)
+}
+
+// LoadOwnerMap reads the file of -acl-owner-map.
+func LoadOwnerMap(name string) (OwnerMap, error) {
+	return internal.LoadOwnerMap(name)
+}
+
+// Options configure an Uploader. Zero values get the defaults of the
+// s3uploader command.
+type Options struct {
+	Destination       ClientConfig
+	DestinationBucket string
+
+	//the cluster Copy reads from, the destination if Endpoint is empty
+	Source       ClientConfig
+	SourceBucket string //the destination bucket if empty
+
+	MultipartThreshold int64 //objects of this size and larger are uploaded in parts
+	PartSize           int64
+	PartConcurrency    int
+
+	Retry RetryPolicy //a single attempt if MaxAttempts is 0
+
+	Sync          bool //skip objects which are the same in the destination
+	SyncByContent bool //skip only objects whose ETag or md5 is the same, not by mtime
+
+	//read and upload objects of the same cluster instead of copying them on
+	//the server, see CopyObject
+	StreamCopy        bool
+	MetadataDirective string
+
+	Metadata     MetadataRules
+	ContentTypes *ContentTypes
+	Acl          AclRules //acl of local files, private by default
+	AclGrants    bool     //reproduce the grants of source objects instead of a canned ACL
+	OwnerMap     OwnerMap
+
+	Limits  *Limits  //may be changed while uploading
+	Metrics *Metrics //may be served while uploading
+
+	//called with the done, skipped, planned and failed events of every
+	//Upload, Copy and Plan, from the goroutine which called them. Uploads
+	//of a Job are passed to the OnEvent of the job instead
+	OnEvent func(Event)
+}
+
+// Uploader uploads to a single destination bucket. Its methods may be
+// called from several goroutines.
+type Uploader struct {
+	options        Options
+	destination    *s3.Bucket
+	source         *s3.Bucket
+	serverSideCopy bool
+}
+
+func New(options Options) (u *Uploader, err error) {
+	if options.MultipartThreshold <= 0 {
+		options.MultipartThreshold = 64 * 1024 * 1024
+	}
+
+	if options.PartSize == 0 {
+		options.PartSize = 16 * 1024 * 1024
+	}
+
+	if options.PartConcurrency <= 0 {
+		options.PartConcurrency = 4
+	}
+
+	if options.PartSize < internal.MinPartSize {
+		err = PartSizeTooSmallError
+		return
+	}
+
+	if options.MetadataDirective == "" {
+		options.MetadataDirective = MetadataDirectiveReplace
+	}
+
+	if options.MetadataDirective != MetadataDirectiveCopy && options.MetadataDirective != MetadataDirectiveReplace {
+		err = InvalidMetadataDirectiveError
+		return
+	}
+
+	if err = options.Metadata.ValidatePatterns(); err != nil {
+		return
+	}
+
+	if options.ContentTypes == nil {
+		options.ContentTypes = NewContentTypes()
+	}
+
+	if options.Acl.Default == "" {
+		options.Acl.Default = s3.Private
+	}
+
+	if options.Limits == nil {
+		options.Limits = NewLimits(0, nil)
+	}
+
+	if options.Metrics == nil {
+		options.Metrics = NewMetrics()
+	}
+
+	if options.SourceBucket == "" {
+		options.SourceBucket = options.DestinationBucket
+	}
+
+	if options.Destination.SignatureVersion == "" {
+		options.Destination.SignatureVersion = SignatureV2
+	}
+
+	u = &Uploader{options: options}
+
+	u.destination = internal.GetS3Client(options.Destination).Bucket(options.DestinationBucket)
+
+	if options.Source.Endpoint == "" || options.Source == options.Destination {
+		u.options.Source = options.Destination
+		u.source = u.destination.S3.Bucket(options.SourceBucket)
+	} else {
+		if u.options.Source.SignatureVersion == "" {
+			u.options.Source.SignatureVersion = SignatureV2
+		}
+		u.source = internal.GetS3Client(u.options.Source).Bucket(options.SourceBucket)
+	}
+
+	u.serverSideCopy = !options.StreamCopy &&
+		u.options.Source.Endpoint == options.Destination.Endpoint &&
+		u.options.Source.AccessKey == options.Destination.AccessKey &&
+		u.options.Source.SecretKey == options.Destination.SecretKey
+
+	return
+}
+
+// Destination returns the destination bucket.
+func (u *Uploader) Destination() *s3.Bucket {
+	return u.destination
+}
+
+// Source returns the bucket Copy reads from.
+func (u *Uploader) Source() *s3.Bucket {
+	return u.source
+}
+
+// ServerSideCopy reports whether Copy copies objects on the server, which it
+// does when source and destination share endpoint and credentials.
+func (u *Uploader) ServerSideCopy() bool {
+	return u.serverSideCopy
+}
+
+// Upload uploads the local file name to key. The returned event is the one
+// passed to OnEvent: done, skipped or failed.
+func (u *Uploader) Upload(ctx context.Context, name string, key string) (event Event, err error) {
+	event, err = u.put(ctx, false, name, key)
+	u.emit(event)
+	return
+}
+
+// Copy copies the object of the source bucket at path source, which may be
+// a url, to key. The returned event is the one passed to OnEvent: done,
+// skipped or failed.
+func (u *Uploader) Copy(ctx context.Context, source string, key string) (event Event, err error) {
+	event, err = u.put(ctx, true, source, key)
+	u.emit(event)
+	return
+}
+
+// Plan returns what Upload, or Copy if sourceIsS3, would do without writing
+// to the destination. Failures are returned in the entry as well.
+func (u *Uploader) Plan(ctx context.Context, sourceIsS3 bool, source string, key string) (entry PlanEntry, err error) {
+	entry, event, err := u.planEntry(ctx, sourceIsS3, source, key)
+	u.emit(event)
+	return
+}
+
+// planEntry returns the entry of Plan and its planned event.
+func (u *Uploader) planEntry(ctx context.Context, sourceIsS3 bool, source string, key string) (entry PlanEntry, event Event, err error) {
+	started := time.Now()
+
+	attempts, err := u.options.Retry.DoContext(ctx, func() (err error) {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		entry, err = u.plan(ctx, sourceIsS3, source, key)
+		return
+	})
+
+	if err != nil && entry.Action == "" {
+		entry = PlanEntry{Source: source, Key: key, Action: PlanActionError, Error: err.Error()}
+	}
+
+	event = finished(Event{Event: EventPlanned, Source: source, Key: key, Size: entry.Size, Mime: entry.ContentType, MimeSource: entry.TypeSource, Acl: entry.Acl, Attempts: attempts, Message: entry.Action}, started)
+
+	return
+}
+
+// put uploads or copies source to key and returns the event of Upload
+// and Copy.
+func (u *Uploader) put(ctx context.Context, sourceIsS3 bool, source string, key string) (event Event, err error) {
+	var (
+		attempts int
+		skipped  bool
+		size     int64
+		fmeta    internal.FileMeta
+	)
+
+	started := time.Now()
+
+	defer func() {
+		if err != nil {
+			event = failure(Event{Source: source, Key: key, Attempts: attempts}, err)
+		}
+		event = finished(event, started)
+	}()
+
+	if u.options.Sync {
+		attempts, err = u.options.Retry.DoContext(ctx, func() (err error) {
+			if err = ctx.Err(); err != nil {
+				return
+			}
+			skipped, size, err = u.unchanged(ctx, sourceIsS3, source, key)
+			return
+		})
+
+		if err != nil {
+			return
+		}
+
+		if skipped {
+			event = Event{Event: EventSkipped, Source: source, Key: key, Size: size, Attempts: attempts}
+			return
+		}
+	}
+
+	attempts, err = u.options.Retry.DoContext(ctx, func() (err error) {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		fmeta, err = u.transfer(ctx, sourceIsS3, source, key)
+		return
+	})
+
+	if err != nil {
+		u.options.Metrics.Retries(attempts)
+		return
+	}
+
+	u.options.Metrics.Upload(time.Since(started), fmeta.Filesize, attempts)
+
+	event = Event{Event: EventDone, Source: source, Key: key, Size: fmeta.Filesize, Mime: fmeta.Mimetype, MimeSource: fmeta.MimeSource, Acl: string(fmeta.Acl), Attempts: attempts}
+
+	return
+}
+
+// emit passes e to OnEvent.
+func (u *Uploader) emit(e Event) {
+	if u.options.OnEvent != nil {
+		u.options.OnEvent(e)
+	}
+}
+
+// finished sets the time and duration of e.
+func finished(e Event, started time.Time) Event {
+	e.Time = time.Now()
+	e.Duration = e.Time.Sub(started).Seconds()
+	return e
+}
+
+// failure makes e the failed event of err.
+func failure(e Event, err error) Event {
+	e.Event = EventFailed
+	e.Error = err.Error()
+	e.Class = string(internal.ClassifyError(err))
+	e.Err = err
+	return e
+}
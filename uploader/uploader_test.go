@@ -0,0 +1,364 @@
+package uploader
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 is an in-memory s3 serving the requests of uploads, copies on the
+// server and their checks. Objects are kept by "/bucket/key" and private
+// to their owner. It must be closed.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	headers map[string]http.Header //x-amz-meta-* and Content-Type of objects
+	server  *httptest.Server
+}
+
+func newFakeS3() *fakeS3 {
+	f := &fakeS3{objects: make(map[string][]byte), headers: make(map[string]http.Header)}
+	f.server = httptest.NewServer(http.HandlerFunc(f.handle))
+	return f
+}
+
+func (f *fakeS3) Close() {
+	f.server.Close()
+}
+
+// config returns the client config of the fake s3.
+func (f *fakeS3) config() ClientConfig {
+	return ClientConfig{UseHttp: true, AccessKey: "a", SecretKey: "b", Endpoint: strings.TrimPrefix(f.server.URL, "http://")}
+}
+
+func (f *fakeS3) object(path string) (content []byte, found bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	content, found = f.objects[path]
+	return
+}
+
+func (f *fakeS3) handle(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	body, _ := ioutil.ReadAll(r.Body)
+
+	etag := func(content []byte) string {
+		sum := md5.Sum(content)
+		return `"` + hex.EncodeToString(sum[:]) + `"`
+	}
+
+	stored := func() http.Header {
+		headers := make(http.Header)
+		for name, values := range r.Header {
+			if strings.HasPrefix(name, "X-Amz-Meta-") || name == "Content-Type" {
+				headers[name] = values
+			}
+		}
+		return headers
+	}
+
+	switch {
+	case r.Method == "PUT" && r.Header.Get("X-Amz-Copy-Source") != "":
+		source, _ := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		content, found := f.objects[source]
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		f.objects[r.URL.Path] = content
+		f.headers[r.URL.Path] = stored()
+		w.Write([]byte("<CopyObjectResult><ETag>" + etag(content) + "</ETag></CopyObjectResult>"))
+	case r.Method == "PUT":
+		f.objects[r.URL.Path] = body
+		f.headers[r.URL.Path] = stored()
+		w.Header().Set("ETag", etag(body))
+	case r.Method == "GET" && hasParam(r, "acl"):
+		if _, found := f.objects[r.URL.Path]; !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("<AccessControlPolicy><Owner><ID>owner</ID></Owner><AccessControlList>" +
+			`<Grant><Grantee xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xsi:type="CanonicalUser"><ID>owner</ID></Grantee><Permission>FULL_CONTROL</Permission></Grant>` +
+			"</AccessControlList></AccessControlPolicy>"))
+	case r.Method == "HEAD" || r.Method == "GET":
+		content, found := f.objects[r.URL.Path]
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		for name, values := range f.headers[r.URL.Path] {
+			w.Header()[name] = values
+		}
+		w.Header().Set("ETag", etag(content))
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		if r.Method == "GET" {
+			w.Write(content)
+		}
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func hasParam(r *http.Request, name string) bool {
+	_, found := r.URL.Query()[name]
+	return found
+}
+
+// events collects the events passed to OnEvent.
+type events struct {
+	mu   sync.Mutex
+	list []Event
+}
+
+func (e *events) add(event Event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.list = append(e.list, event)
+}
+
+func (e *events) all() []Event {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return append([]Event{}, e.list...)
+}
+
+// tempFile writes content to a file of dir and returns its name.
+func tempFile(t *testing.T, dir string, name string, content string) string {
+	name = filepath.Join(dir, name)
+	if err := ioutil.WriteFile(name, []byte(content), 0666); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestZeroLimits(t *testing.T) {
+	var l Limits
+
+	if rate := l.Global().Rate(); rate != 0 {
+		t.Errorf("global rate %d of zero limits", rate)
+	}
+
+	if rate := l.Endpoint("s3.example.com").Rate(); rate != 0 {
+		t.Errorf("endpoint rate %d of zero limits", rate)
+	}
+
+	l.Set(1024, map[string]int64{"s3.example.com": 512})
+
+	if rate := l.Global().Rate(); rate != 1024 {
+		t.Errorf("global rate %d, expected 1024", rate)
+	}
+
+	if rate := l.Endpoint("s3.example.com").Rate(); rate != 512 {
+		t.Errorf("endpoint rate %d, expected 512", rate)
+	}
+}
+
+func TestZeroMetrics(t *testing.T) {
+	var m Metrics
+
+	m.Error(errors.New("failed"))
+	m.Upload(0, 10, 2)
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	for _, line := range []string{
+		`s3uploader_errors_total{class="unknown"} 1`,
+		"s3uploader_retries_total 1",
+		"s3uploader_upload_size_bytes_count 1",
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Errorf("no %q in metrics:\n%s", line, w.Body.String())
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	f := newFakeS3()
+	defer f.Close()
+
+	u, err := New(Options{Destination: f.config(), DestinationBucket: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options := u.options
+	if options.MultipartThreshold != 64*1024*1024 || options.PartSize != 16*1024*1024 || options.PartConcurrency != 4 {
+		t.Errorf("multipart defaults %d, %d, %d", options.MultipartThreshold, options.PartSize, options.PartConcurrency)
+	}
+
+	if options.MetadataDirective != MetadataDirectiveReplace || options.Acl.Default != "private" || options.SourceBucket != "b" {
+		t.Errorf("defaults %q, %q, %q", options.MetadataDirective, options.Acl.Default, options.SourceBucket)
+	}
+
+	if options.ContentTypes == nil || options.Limits == nil || options.Metrics == nil {
+		t.Error("content types, limits or metrics not set")
+	}
+
+	if !u.ServerSideCopy() || u.Source().Name != "b" || u.Destination().Name != "b" {
+		t.Errorf("source %s, destination %s, server side copy %v", u.Source().Name, u.Destination().Name, u.ServerSideCopy())
+	}
+
+	if _, err = New(Options{Destination: f.config(), PartSize: 1024}); !errors.Is(err, PartSizeTooSmallError) {
+		t.Errorf("small parts: error %v", err)
+	}
+
+	if _, err = New(Options{Destination: f.config(), MetadataDirective: "KEEP"}); !errors.Is(err, InvalidMetadataDirectiveError) {
+		t.Errorf("unknown directive: error %v", err)
+	}
+}
+
+func TestUpload(t *testing.T) {
+	f := newFakeS3()
+	defer f.Close()
+
+	dir, err := ioutil.TempDir("", "uploader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := tempFile(t, dir, "a.txt", "hello")
+
+	var got events
+	u, err := New(Options{Destination: f.config(), DestinationBucket: "b", Sync: true, OnEvent: got.add})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event, err := u.Upload(context.Background(), name, "dir/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if event.Event != EventDone || event.Source != name || event.Key != "dir/a.txt" || event.Size != 5 || event.Mime != "text/plain; charset=utf-8" {
+		t.Errorf("event %+v", event)
+	}
+
+	if content, _ := f.object("/b/dir/a.txt"); string(content) != "hello" {
+		t.Errorf("object %q", content)
+	}
+
+	//unchanged in sync mode
+	if event, err = u.Upload(context.Background(), name, "dir/a.txt"); err != nil || event.Event != EventSkipped || event.Size != 5 {
+		t.Errorf("second upload %+v, %v", event, err)
+	}
+
+	_, err = u.Upload(context.Background(), filepath.Join(dir, "missing.txt"), "missing.txt")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing file: error %v", err)
+	}
+
+	all := got.all()
+	if len(all) != 3 || all[0].Event != EventDone || all[1].Event != EventSkipped || all[2].Event != EventFailed {
+		t.Fatalf("events %+v", all)
+	}
+
+	if failed := all[2]; failed.Err != err || failed.Class != "not_found" || failed.Error != err.Error() {
+		t.Errorf("failed event %+v", failed)
+	}
+}
+
+func TestUploadCanceled(t *testing.T) {
+	f := newFakeS3()
+	defer f.Close()
+
+	dir, err := ioutil.TempDir("", "uploader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	u, err := New(Options{Destination: f.config(), DestinationBucket: "b", Retry: RetryPolicy{MaxAttempts: 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	event, err := u.Upload(ctx, tempFile(t, dir, "a.txt", "hello"), "a.txt")
+	if !errors.Is(err, context.Canceled) || event.Event != EventFailed {
+		t.Errorf("event %+v, error %v", event, err)
+	}
+
+	if _, found := f.object("/b/a.txt"); found {
+		t.Error("canceled upload stored")
+	}
+}
+
+func TestCopy(t *testing.T) {
+	f := newFakeS3()
+	defer f.Close()
+
+	f.objects["/src/a.txt"] = []byte("hello")
+	f.headers["/src/a.txt"] = http.Header{"Content-Type": {"text/plain"}}
+
+	u, err := New(Options{Destination: f.config(), DestinationBucket: "b", SourceBucket: "src"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event, err := u.Copy(context.Background(), "/a.txt", "copy/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if event.Event != EventDone || event.Size != 5 {
+		t.Errorf("event %+v", event)
+	}
+
+	if content, _ := f.object("/b/copy/a.txt"); string(content) != "hello" {
+		t.Errorf("copy %q", content)
+	}
+
+	if _, err = u.Copy(context.Background(), "/missing.txt", "missing.txt"); err == nil {
+		t.Error("copy of a missing object")
+	}
+}
+
+func TestPlan(t *testing.T) {
+	f := newFakeS3()
+	defer f.Close()
+
+	dir, err := ioutil.TempDir("", "uploader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var got events
+	u, err := New(Options{Destination: f.config(), DestinationBucket: "b", OnEvent: got.add})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := u.Plan(context.Background(), false, tempFile(t, dir, "a.txt", "hello"), "a.txt")
+	if err != nil || entry.Action != PlanActionUpload || entry.Size != 5 {
+		t.Errorf("entry %+v, %v", entry, err)
+	}
+
+	if _, found := f.object("/b/a.txt"); found {
+		t.Error("planned upload stored")
+	}
+
+	if all := got.all(); len(all) != 1 || all[0].Event != EventPlanned || all[0].Message != PlanActionUpload {
+		t.Errorf("events %+v", all)
+	}
+}